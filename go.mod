@@ -1,3 +1,3 @@
 module github.com/autom8ter/thermomatic
 
-go 1.12
+go 1.13
@@ -2,13 +2,16 @@ package client
 
 import (
 	"context"
+	"io"
 	"net"
+	"time"
 )
 
-//Cache can persist,fetch, and delete each client's last reading in memory
+//Cache can persist,fetch, and delete each client's last reading in memory. SetReading stores a copy of the reading
+//and GetReading returns a copy, so readings may be reused by the caller
 type Cache interface {
 	SetReading(imei uint64, reading *Reading)
-	GetReading(imei uint64) (*Reading, bool)
+	GetReading(imei uint64) (Reading, bool)
 	DeleteReading(imei uint64)
 }
 
@@ -19,12 +22,44 @@ type ClientConn interface {
 	GetIMEI() uint64
 	GetManager() Manager
 	Connect(ctx context.Context)
-	Close()
+	//Close closes the connection for the given reason. It is safe to call any number of times from any goroutine,
+	//only the first reason is recorded
+	Close(reason CloseReason)
+	//CloseReason returns why the connection was closed, or zero if it hasn't been
+	CloseReason() CloseReason
+	//State returns the current state of the connection
+	State() State
+	//StateEntered returns when the connection last entered the given state, or the zero time if it never has
+	StateEntered(s State) time.Time
+	//Metrics returns a snapshot of the connection's traffic & quality metrics
+	Metrics() Metrics
+	//Send writes a command to the device(see WithCommands)
+	Send(cmd Command) error
 }
 
+//ErrorHandler handles errors that occur during the lifecycle of a client connection
+type ErrorHandler func(c ClientConn, err error)
+
+//LoginHandler logs a client in from its login message(its imei). The connection is closed if an error is returned
+type LoginHandler func(c ClientConn, b []byte) error
+
+//ReadingHandler handles each decoded reading. The reading is reused for the client's next message once the handler
+//returns, so it must be copied to be retained
+type ReadingHandler func(c ClientConn, reading *Reading) error
+
+//DoneHandler is executed once a logged in client's connection is closing
+type DoneHandler func(c ClientConn)
+
+//ReadingMiddleware wraps a ReadingHandler. A middleware may modify the reading before passing it to next, or drop it by
+//returning without calling next
+type ReadingMiddleware func(next ReadingHandler) ReadingHandler
+
+//ClientHub tracks logged in client connections. AddClient returns an error if the client may not log in(ex: the
+//hub's duplicate login policy rejects it). RemoveClient only removes the given session and reports whether it was
+//the last session of its imei. The hub decides how long the reading of a device without sessions stays cached.
 type ClientHub interface {
-	AddClient(c ClientConn)
-	RemoveClient(imei uint64)
+	AddClient(c ClientConn) error
+	RemoveClient(c ClientConn) bool
 }
 
 //Logger gets client and server loggers
@@ -37,9 +72,18 @@ type Printer interface {
 	Printf(format string, args ...interface{})
 }
 
+//Output gets the writer that reading records are written to. Each Write is passed exactly one record, which the writer
+//must not retain
+type Output interface {
+	GetReadingOutput() io.Writer
+}
+
 //Manager manages client connections (implemented by server.Server
 type Manager interface {
 	Logger
+	Output
 	ClientHub
 	Cache
+	StateObserver
+	CommandObserver
 }
@@ -7,122 +7,284 @@ import (
 	"github.com/autom8ter/thermomatic/internal/imei"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 //client implements ClientConn
 type client struct {
 	conn net.Conn
-	//imei is the clients imei(unique identifier)
+	//imei is the clients imei(unique identifier). It's accessed atomically since other goroutines log it
 	imei    uint64
 	manager Manager
 	//handleErr handles all errors during the lifecycle of the connection
-	handleErr func(c ClientConn, err error)
+	handleErr ErrorHandler
 	//handleReading handles all client readings during the lifecycle of the connection
-	handleReading func(c ClientConn, reading *Reading) error
-	//handleLogin handles the clients first message to log them in. The connection will be closed if an error is returned
-	handleLogin func(c ClientConn) error
+	handleReading ReadingHandler
+	//middleware wraps handleReading once every option has been applied, the first middleware runs first
+	middleware []ReadingMiddleware
+	//handleLogin handles the clients first message(its imei) to log them in. The connection will be closed if an error is returned
+	handleLogin LoginHandler
 	//handleDone is executed when the client connection is closing
-	handleDone func(c ClientConn)
-	close      chan struct{}
+	handleDone DoneHandler
+	//close is closed once the connection is closing & reason holds why
+	close  chan struct{}
+	reason int32
+	//loginTimeout is how long the client has to send its login message
+	loginTimeout time.Duration
+	//readTimeout is how long the client may go without sending a reading
+	readTimeout time.Duration
+	//writeTimeout is how long a command may take to be written to the connection
+	writeTimeout time.Duration
+	//protocol is the protocol version negotiated at login. It's only accessed by the goroutine serving the connection
+	protocol int
+	//commands enables the command downlink & acknowledgement frames. writeMu serializes command writes
+	commands bool
+	writeMu  sync.Mutex
+	//detach is set when the connection is serviced by a Poller. It removes the client from the poller & closes it
+	detach func()
+	//frames splits the connection's byte stream into messages
+	frames frameReader
+	//reading, record & batch are reused for every message so the read loop doesn't allocate
+	reading Reading
+	record  []byte
+	batch   []batchEntry
+	//state is the connection's State, entered holds when each state was last entered in unix nanoseconds
+	state   int32
+	entered [StateClosed + 1]int64
+	metrics metrics
+	//validator validates the client's readings. selectValidator picks the validator of the imei once the client has
+	//logged in
+	validator       *Validator
+	selectValidator func(imei uint64) *Validator
+	//invalidPolicy decides when a connection sending invalid readings is closed
+	invalidPolicy InvalidReadingPolicy
+	invalid       invalidReadings
 }
 
-//NewClient creates a new ClientConn with default event handlers. clientLog will be used to log readings
-func NewClient(conn net.Conn, manager Manager) (ClientConn, error) {
+//NewClient creates a new ClientConn with default event handlers, which may be replaced or wrapped with options(see
+//WithReadingMiddleware). Readings are written to the manager's reading output
+func NewClient(conn net.Conn, manager Manager, opts ...Option) (ClientConn, error) {
 	client := &client{
-		conn:    conn,
-		manager: manager,
+		conn:         conn,
+		manager:      manager,
+		loginTimeout: 1 * time.Second,
+		readTimeout:  2 * time.Second,
+		writeTimeout: 1 * time.Second,
+		protocol:     ProtocolV1,
+		validator:    &defaultValidator,
 		handleErr: func(c ClientConn, err error) {
 			manager.GetServerLogger().Printf("[ERROR] %v error: %s", c.GetIMEI(), err)
 		},
-		close: make(chan struct{}, 1),
+		close:  make(chan struct{}),
+		record: make([]byte, 0, 128),
 	}
-	client.handleLogin = func(c ClientConn) error {
-		if err := conn.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
-			return err
-		}
-		b := make([]byte, 15) //read imei from connection
-		if _, err := conn.Read(b); err != nil {
-			return err
-		}
-		//if _, err := io.ReadFull(conn, b); err != nil {
-		//	return err
-		//}
+	client.frames = newFrameReader(conn, &client.metrics.bytesRead)
+	client.handleLogin = func(c ClientConn, b []byte) error {
 		code, err := imei.Decode(b)
 		if err != nil {
-			return err
+			return &CloseError{Reason: CloseInvalidIMEI, Err: err}
 		}
 		c.SetIMEI(code)
-		c.GetManager().AddClient(c)
-		return nil
+		return c.GetManager().AddClient(c)
 	}
 	client.handleReading = func(c ClientConn, message *Reading) error {
 		if c.GetIMEI() == 0 {
 			return fmt.Errorf("failed handle reading: empty imei code")
 		}
-		message.Log(c.GetIMEI(), c.GetManager().GetClientLogger())
+		client.record = message.AppendCSV(client.record[:0], c.GetIMEI())
+		if _, err := c.GetManager().GetReadingOutput().Write(client.record); err != nil {
+			return err
+		}
 		c.GetManager().SetReading(c.GetIMEI(), message)
 		return nil
 	}
 	client.handleDone = func(c ClientConn) {
-		c.GetManager().DeleteReading(c.GetIMEI())
-		c.GetManager().RemoveClient(c.GetIMEI())
+		c.GetManager().RemoveClient(c)
 	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	for i := len(client.middleware) - 1; i >= 0; i-- {
+		client.handleReading = client.middleware[i](client.handleReading)
+	}
+	client.entered[StateAccepted] = time.Now().UnixNano()
+	manager.StateChanged(client, StateAccepted, StateAccepted)
 	return client, nil
 }
 
-//Connect handles the lifecycle of the client connection using the clients event handlers(see other methods to override)
+//Connect handles the lifecycle of the client connection using the clients event handlers(see other methods to override).
+//Connect returns once the connection is closed or ctx is cancelled. On cancellation the connection is closed with a
+//CloseServerShutdown reason so that any blocked read returns immediately.
 func (c *client) Connect(ctx context.Context) {
-	defer c.conn.Close()
+	defer c.closed()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close(CloseServerShutdown)
+		case <-done:
+		}
+	}()
+	if reason, err := c.login(); err != nil {
+		if c.CloseReason() == 0 {
+			c.handleErr(c, fmt.Errorf("client login: %s", err))
+			c.Close(reason)
+		}
+		return
+	}
+	defer c.handleDone(c)
 	for {
 		select {
+		case <-c.close:
+			return
 		default:
-			if c.GetIMEI() == 0 {
-				//handleLogin when the client first establishes a conectionn
-				if err := c.handleLogin(c); err != nil {
-					c.handleErr(c, fmt.Errorf("client login: %s", err))
-					c.Close()
-					return
-				}
-
-			}
-			if err := c.GetConn().SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		}
+		//the read timeout is split in two halves, the connection is idle after the first
+		timeout := c.readTimeout / 2
+		if c.State() == StateIdleWarning {
+			timeout = c.readTimeout - timeout
+		}
+		if err := c.GetConn().SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			if c.CloseReason() == 0 {
 				c.handleErr(c, fmt.Errorf("client read timeout: %s", err))
-				c.Close()
+				c.Close(CloseReadError)
+			}
+			return
+		}
+		b, err := c.nextMessage() //read reading from connection
+		if err != nil {
+			if c.CloseReason() != 0 {
+				//the connection was closed by another goroutine, ex: it was evicted
 				return
 			}
-			b := make([]byte, 40) //read imei from connection
-			if _, err := c.GetConn().Read(b); err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					c.handleErr(c, fmt.Errorf("client timeout: %s", err))
-					c.Close()
-					continue
-				}
-				if err == io.EOF {
-					continue
-				}
-				c.handleErr(c, fmt.Errorf("failed to read message: %s", err))
+			reason := readCloseReason(err, CloseIdleTimeout)
+			switch {
+			case reason == CloseIdleTimeout && c.State() == StateActive:
+				c.setState(StateIdleWarning)
 				continue
+			case reason == CloseIdleTimeout:
+				c.handleErr(c, fmt.Errorf("client timeout: %s", err))
+			case reason == CloseProtocolError:
+				c.handleErr(c, err)
+			case err == io.ErrUnexpectedEOF:
+				size, _ := c.frameSize(c.frames.buf[c.frames.start:c.frames.end])
+				c.handleErr(c, fmt.Errorf("connection closed mid-message: received %v of %v bytes", c.frames.buffered(), size))
+			case reason == CloseReadError:
+				c.handleErr(c, fmt.Errorf("failed to read message: %s", err))
 			}
-			var reading = new(Reading)
-			if len(b) >= common.MinReadingLength {
-				ok, err := reading.Decode(b)
-				if err != nil {
-					c.handleErr(c, fmt.Errorf("decode reading: %s", err))
-					continue
-				}
-				if ok {
-					if err := c.handleReading(c, reading); err != nil {
-						c.handleErr(c, fmt.Errorf("handle reading: %s", err))
-					}
-				}
-			}
-		case <-ctx.Done():
-			c.handleDone(c)
-			break
-		case <-c.close:
-			c.handleDone(c)
-			break
+			c.Close(reason)
+			return
+		}
+		c.setState(StateActive)
+		c.handleMessage(b)
+	}
+}
+
+//closed closes the connection once Connect returns
+func (c *client) closed() {
+	c.setState(StateClosing)
+	c.conn.Close()
+	c.setState(StateClosed)
+}
+
+//login reads the login message from the connection and logs the client in. If the login fails, the reason the
+//connection should be closed is returned
+func (c *client) login() (CloseReason, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.loginTimeout)); err != nil {
+		return CloseReadError, err
+	}
+	//the client is authenticating once the first bytes of its login message arrive
+	if c.frames.buffered() == 0 {
+		if err := c.frames.fill(LoginV2Length); err != nil && c.frames.buffered() == 0 {
+			return readCloseReason(err, CloseLoginTimeout), err
+		}
+	}
+	c.setState(StateAuthenticating)
+	b, err := c.nextMessage() //read imei from connection
+	if err != nil {
+		return readCloseReason(err, CloseLoginTimeout), err
+	}
+	if err := c.loginMessage(b); err != nil {
+		return loginCloseReason(err), err
+	}
+	c.observeLogin(time.Now())
+	c.setState(StateActive)
+	return 0, nil
+}
+
+//nextMessage reads the next login, reading or v2 frame message from the connection. An invalid v2 frame header is
+//returned as a CloseError with CloseProtocolError
+func (c *client) nextMessage() ([]byte, error) {
+	var buffered []byte
+	for {
+		size, err := c.frameSize(buffered)
+		if err != nil {
+			return nil, &CloseError{Reason: CloseProtocolError, Err: err}
+		}
+		if size <= len(buffered) {
+			return c.frames.next(size)
+		}
+		if buffered, err = c.frames.peek(size); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//handleMessage decodes a reading message or v2 frame and hands valid readings to the reading handler
+func (c *client) handleMessage(b []byte) {
+	if c.protocol == ProtocolV2 {
+		c.handleFrame(b)
+		return
+	}
+	if len(b) < common.MinReadingLength {
+		return
+	}
+	if c.commands && isAck(b) {
+		c.handleAck(b)
+		return
+	}
+	c.handleDecoded(c.decode(b))
+}
+
+//decode decodes the reading message b into the client's reading & validates it with the client's validator. It returns
+//nil if the reading is valid & does NOT allocate unless the reading is invalid
+func (c *client) decode(b []byte) *ValidationError {
+	c.reading.decode(b)
+	return c.validator.validate(&c.reading)
+}
+
+//handleAck passes an acknowledgement frame to the manager
+func (c *client) handleAck(b []byte) {
+	var ack Ack
+	ack.Decode(b)
+	c.manager.GetServerLogger().Printf("[INFO] %v acknowledged command %v: %s", c.GetIMEI(), ack.ID, ack.Status)
+	c.manager.CommandAcked(c, ack)
+}
+
+//handleDecoded records the decoded reading & hands it to the reading handler if it's valid, which it is if invalid is
+//nil
+func (c *client) handleDecoded(invalid *ValidationError) {
+	reading := &c.reading
+	if reading.Backfilled {
+		c.observeBackfill(invalid)
+	} else {
+		c.observeReading(reading.Timestamp, invalid)
+	}
+	if invalid != nil {
+		c.handleErr(c, fmt.Errorf("decode reading: %w", invalid))
+	}
+	ok := invalid == nil
+	if err := c.checkReading(ok); err != nil {
+		c.handleErr(c, fmt.Errorf("invalid reading policy: %s", err))
+		c.Close(CloseInvalidReadings)
+		return
+	}
+	if ok {
+		if err := c.handleReading(c, reading); err != nil {
+			c.handleErr(c, fmt.Errorf("handle reading: %s", err))
 		}
 	}
 }
@@ -134,19 +296,14 @@ func (c *client) GetConn() net.Conn {
 
 //SetIMEI sets the clients imei code
 func (c *client) SetIMEI(code uint64) {
-	c.imei = code
+	atomic.StoreUint64(&c.imei, code)
 }
 
 //GetIMEI retrieves the clients imei code
 func (c *client) GetIMEI() uint64 {
-	return c.imei
+	return atomic.LoadUint64(&c.imei)
 }
 
 func (c *client) GetManager() Manager {
 	return c.manager
 }
-
-//Close is used to close a client connection
-func (c *client) Close() {
-	c.close <- struct{}{}
-}
@@ -0,0 +1,1030 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/client"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//manager is a client.Manager that counts logins & readings
+type manager struct {
+	logger   *log.Logger
+	output   io.Writer
+	logins   int64
+	readings int64
+	done     int64
+	mu       sync.Mutex
+	last     client.Reading
+	//states receives every state transition if it isn't nil
+	states chan client.State
+	//acks receives every command acknowledgement if it isn't nil
+	acks chan client.Ack
+}
+
+func newManager() *manager {
+	return &manager{
+		logger: log.New(ioutil.Discard, "", 0),
+		output: ioutil.Discard,
+	}
+}
+
+func (m *manager) GetClientLogger() client.Printer { return m.logger }
+func (m *manager) GetServerLogger() client.Printer { return m.logger }
+func (m *manager) GetReadingOutput() io.Writer     { return m.output }
+func (m *manager) AddClient(c client.ClientConn) error {
+	atomic.AddInt64(&m.logins, 1)
+	return nil
+}
+func (m *manager) RemoveClient(c client.ClientConn) bool {
+	atomic.AddInt64(&m.done, 1)
+	return true
+}
+func (m *manager) SetReading(imei uint64, reading *client.Reading) {
+	m.mu.Lock()
+	m.last = *reading
+	m.mu.Unlock()
+	atomic.AddInt64(&m.readings, 1)
+}
+func (m *manager) GetReading(imei uint64) (client.Reading, bool) { return client.Reading{}, false }
+func (m *manager) DeleteReading(imei uint64)                     {}
+func (m *manager) StateChanged(c client.ClientConn, from, to client.State) {
+	if m.states != nil {
+		m.states <- to
+	}
+}
+func (m *manager) CommandAcked(c client.ClientConn, ack client.Ack) {
+	if m.acks != nil {
+		m.acks <- ack
+	}
+}
+
+//waitFor polls cond until it's true or the timeout elapses
+func waitFor(t testing.TB, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//testIMEI returns a valid imei code for the nth device
+func testIMEI(n int) []byte {
+	code := []byte(fmt.Sprintf("45015460%06d", n))
+	sum := 0
+	for i, digit := range code {
+		d := int(digit - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d >= 10 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return strconv.AppendInt(code, int64((10-sum%10)%10), 10)
+}
+
+//pipe returns a connected pair of tcp connections(device, server)
+func pipe(t testing.TB, lis net.Listener) (net.Conn, net.Conn) {
+	device, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return device, conn
+}
+
+//memConn is an in-memory net.Conn. Each message sent on in is returned by Read
+type memConn struct {
+	in      chan []byte
+	pending []byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newMemConn() *memConn {
+	return &memConn{
+		in:     make(chan []byte),
+		closed: make(chan struct{}),
+	}
+}
+
+var memAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1337}
+
+func (m *memConn) Read(b []byte) (int, error) {
+	if len(m.pending) == 0 {
+		select {
+		case m.pending = <-m.in:
+		case <-m.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, m.pending)
+	m.pending = m.pending[n:]
+	return n, nil
+}
+func (m *memConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (m *memConn) Close() error                       { m.once.Do(func() { close(m.closed) }); return nil }
+func (m *memConn) LocalAddr() net.Addr                { return memAddr }
+func (m *memConn) RemoteAddr() net.Addr               { return memAddr }
+func (m *memConn) SetDeadline(t time.Time) error      { return nil }
+func (m *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+//lockedBuffer is a bytes.Buffer that is safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(b)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+//signalWriter signals written after each write
+type signalWriter struct {
+	written chan struct{}
+}
+
+func (s *signalWriter) Write(b []byte) (int, error) {
+	s.written <- struct{}{}
+	return len(b), nil
+}
+
+//TestConnectAllocs fails if the Connect loop allocates while reading, decoding and writing readings
+func TestConnectAllocs(t *testing.T) {
+	var (
+		m      = newManager()
+		conn   = newMemConn()
+		output = &signalWriter{written: make(chan struct{})}
+	)
+	m.output = output
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, _ := client.NewClient(conn, m)
+	go c.Connect(ctx)
+	conn.in <- testIMEI(1)
+	//warm up the connection's buffers
+	conn.in <- singleEncodedReading
+	<-output.written
+	apr := testing.AllocsPerRun(5000, func() {
+		conn.in <- singleEncodedReading
+		<-output.written
+	})
+	if apr > 0 {
+		t.Fatalf("allocations per run is greater than zero! %v", apr)
+	}
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&m.readings) == 5002 })
+}
+
+//TestConnectFraming fails if messages aren't decoded from a stream fragmented or coalesced at arbitrary boundaries,
+//or if a partial message isn't detected when the connection closes
+func TestConnectFraming(t *testing.T) {
+	const readings = 100
+	stream := testIMEI(1)
+	for i := 0; i < readings; i++ {
+		stream = append(stream, singleEncodedReading...)
+	}
+	tests := []struct {
+		Name string
+		//Chunk is the size of each write
+		Chunk int
+		//Trailing is the number of bytes of a partial message written before closing the connection
+		Trailing int
+	}{
+		{Name: "one byte at a time", Chunk: 1},
+		{Name: "odd fragments", Chunk: 7},
+		{Name: "one large batch", Chunk: len(stream)},
+		{Name: "trailing partial message", Chunk: 64, Trailing: 25},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var (
+				logs         bytes.Buffer
+				m            = newManager()
+				device, conn = net.Pipe()
+				done         = make(chan struct{})
+			)
+			m.logger = log.New(&logs, "", 0)
+			c, _ := client.NewClient(conn, m)
+			go func() {
+				defer close(done)
+				c.Connect(context.Background())
+			}()
+			data := append(append([]byte(nil), stream...), singleEncodedReading[:test.Trailing]...)
+			for i := 0; i < len(data); i += test.Chunk {
+				end := i + test.Chunk
+				if end > len(data) {
+					end = len(data)
+				}
+				if _, err := device.Write(data[i:end]); err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+			waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&m.readings) == readings })
+			m.mu.Lock()
+			last := m.last
+			m.mu.Unlock()
+			if last.Temperature != 102.45 || last.Longitude != -165.00857800000001 {
+				t.Fatalf("decoded reading doesn't match encoded reading: %+v", last)
+			}
+			device.Close()
+			if test.Trailing == 0 {
+				return
+			}
+			<-done
+			if !strings.Contains(logs.String(), fmt.Sprintf("received %v of 40 bytes", test.Trailing)) {
+				t.Fatalf("expected partial message to be logged: %s", logs.String())
+			}
+		})
+	}
+}
+
+//TestReadingMiddleware fails if reading middleware doesn't run in order around the reading handler, or can't modify
+//or drop readings
+func TestReadingMiddleware(t *testing.T) {
+	var (
+		m     = newManager()
+		conn  = newMemConn()
+		order []string
+		//handled receives the temperature of every reading that reaches the reading handler
+		handled = make(chan float64, 1)
+	)
+	trace := func(name string) client.ReadingMiddleware {
+		return func(next client.ReadingHandler) client.ReadingHandler {
+			return func(c client.ClientConn, reading *client.Reading) error {
+				order = append(order, name)
+				return next(c, reading)
+			}
+		}
+	}
+	//celsius converts the temperature from fahrenheit
+	celsius := func(next client.ReadingHandler) client.ReadingHandler {
+		return func(c client.ClientConn, reading *client.Reading) error {
+			reading.Temperature = (reading.Temperature - 32) * 5 / 9
+			return next(c, reading)
+		}
+	}
+	//lowBattery drops readings of devices that are about to die
+	lowBattery := func(next client.ReadingHandler) client.ReadingHandler {
+		return func(c client.ClientConn, reading *client.Reading) error {
+			if reading.BatteryLevel < 1 {
+				return nil
+			}
+			return next(c, reading)
+		}
+	}
+	c, _ := client.NewClient(conn, m,
+		client.WithReadingMiddleware(trace("first"), celsius),
+		client.WithReadingHandler(func(c client.ClientConn, reading *client.Reading) error {
+			order = append(order, "handler")
+			handled <- reading.Temperature
+			return nil
+		}),
+		client.WithReadingMiddleware(lowBattery, trace("last")),
+		client.WrapLoginHandler(func(next client.LoginHandler) client.LoginHandler {
+			return func(c client.ClientConn, b []byte) error {
+				order = append(order, "login")
+				return next(c, b)
+			}
+		}),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Connect(ctx)
+	conn.in <- testIMEI(1)
+	reading := &client.Reading{Temperature: 212, BatteryLevel: 0.5}
+	for _, battery := range []float64{0.5, 50} {
+		reading.BatteryLevel = battery
+		b, err := reading.Encode()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.in <- b
+	}
+	if temperature := <-handled; temperature != 100 {
+		t.Fatalf("expected temperature to be converted to celsius actual = %v", temperature)
+	}
+	expected := "login first first last handler"
+	if actual := strings.Join(order, " "); actual != expected {
+		t.Fatalf("expected order %q actual = %q", expected, actual)
+	}
+	if atomic.LoadInt64(&m.logins) != 1 || atomic.LoadInt64(&m.readings) != 0 {
+		t.Fatal("expected the default login handler to run & the reading handler to be replaced")
+	}
+}
+
+//TestConnectStates fails if a connection doesn't move through the lifecycle states in order, or doesn't record when
+//each state was entered
+func TestConnectStates(t *testing.T) {
+	var (
+		m            = newManager()
+		device, conn = net.Pipe()
+	)
+	defer device.Close()
+	m.states = make(chan client.State, 16)
+	c, _ := client.NewClient(conn, m, client.WithReadTimeout(200*time.Millisecond))
+	expect := func(states ...client.State) {
+		t.Helper()
+		for _, state := range states {
+			select {
+			case actual := <-m.states:
+				if actual != state {
+					t.Fatalf("expected state %s actual = %s", state, actual)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for state %s", state)
+			}
+		}
+	}
+	expect(client.StateAccepted)
+	go c.Connect(context.Background())
+	login := testIMEI(1)
+	device.Write(login[:5])
+	expect(client.StateAuthenticating)
+	device.Write(login[5:])
+	expect(client.StateActive)
+	//the connection is idle after half of the read timeout
+	expect(client.StateIdleWarning)
+	device.Write(singleEncodedReading)
+	expect(client.StateActive, client.StateIdleWarning, client.StateClosing, client.StateClosed)
+	if c.State() != client.StateClosed {
+		t.Fatalf("expected closed connection actual = %s", c.State())
+	}
+	accepted, closed := c.StateEntered(client.StateAccepted), c.StateEntered(client.StateClosed)
+	if accepted.IsZero() || closed.Sub(accepted) < 200*time.Millisecond {
+		t.Fatalf("expected connection to be open for at least the read timeout: %s - %s", accepted, closed)
+	}
+}
+
+//TestCloseReasons fails if Connect doesn't return promptly with the reason the connection was closed for
+func TestCloseReasons(t *testing.T) {
+	banned := client.WrapLoginHandler(func(next client.LoginHandler) client.LoginHandler {
+		return func(c client.ClientConn, b []byte) error {
+			return &client.CloseError{Reason: client.CloseBanned, Err: fmt.Errorf("banned")}
+		}
+	})
+	invalid, err := (&client.Reading{Temperature: 500}).Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//readings writes the login message followed by a reading per byte of pattern, 'x' being an invalid reading
+	readings := func(pattern string) []byte {
+		b := testIMEI(1)
+		for _, r := range pattern {
+			if r == 'x' {
+				b = append(b, invalid...)
+			} else {
+				b = append(b, singleEncodedReading...)
+			}
+		}
+		return b
+	}
+	tests := []struct {
+		Name    string
+		Options []client.Option
+		//Device writes to & closes the device side of the connection, cancel shuts the server down
+		Device func(device net.Conn, cancel context.CancelFunc)
+		Reason client.CloseReason
+	}{
+		{
+			Name:   "login timeout",
+			Device: func(device net.Conn, cancel context.CancelFunc) {},
+			Reason: client.CloseLoginTimeout,
+		},
+		{
+			Name:   "invalid imei",
+			Device: func(device net.Conn, cancel context.CancelFunc) { device.Write([]byte("450154603277519")) },
+			Reason: client.CloseInvalidIMEI,
+		},
+		{
+			Name:    "banned",
+			Options: []client.Option{banned},
+			Device:  func(device net.Conn, cancel context.CancelFunc) { device.Write(testIMEI(1)) },
+			Reason:  client.CloseBanned,
+		},
+		{
+			Name: "peer eof",
+			Device: func(device net.Conn, cancel context.CancelFunc) {
+				device.Write(testIMEI(1))
+				device.Close()
+			},
+			Reason: client.ClosePeerEOF,
+		},
+		{
+			Name:   "idle timeout",
+			Device: func(device net.Conn, cancel context.CancelFunc) { device.Write(testIMEI(1)) },
+			Reason: client.CloseIdleTimeout,
+		},
+		{
+			Name:    "consecutive invalid readings",
+			Options: []client.Option{client.WithInvalidReadingPolicy(client.InvalidReadingPolicy{MaxConsecutive: 3})},
+			Device:  func(device net.Conn, cancel context.CancelFunc) { device.Write(readings("xxvxxx")) },
+			Reason:  client.CloseInvalidReadings,
+		},
+		{
+			Name:    "invalid reading ratio",
+			Options: []client.Option{client.WithInvalidReadingPolicy(client.InvalidReadingPolicy{Window: 4, MaxRatio: 0.5})},
+			Device:  func(device net.Conn, cancel context.CancelFunc) { device.Write(readings("xvxvxx")) },
+			Reason:  client.CloseInvalidReadings,
+		},
+		{
+			Name:    "invalid reading ratio of the largest window",
+			Options: []client.Option{client.WithInvalidReadingPolicy(client.InvalidReadingPolicy{Window: client.MaxInvalidWindow, MaxRatio: 0.5})},
+			Device: func(device net.Conn, cancel context.CancelFunc) {
+				device.Write(readings(strings.Repeat("x", 33) + strings.Repeat("v", 31)))
+			},
+			Reason: client.CloseInvalidReadings,
+		},
+		{
+			Name: "server shutdown",
+			Device: func(device net.Conn, cancel context.CancelFunc) {
+				device.Write(testIMEI(1))
+				cancel()
+			},
+			Reason: client.CloseServerShutdown,
+		},
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lis.Close()
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var (
+				m            = newManager()
+				device, conn = pipe(t, lis)
+				done         = make(chan struct{})
+			)
+			defer device.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opts := append([]client.Option{
+				client.WithLoginTimeout(100 * time.Millisecond),
+				client.WithReadTimeout(100 * time.Millisecond),
+			}, test.Options...)
+			c, _ := client.NewClient(conn, m, opts...)
+			go func() {
+				defer close(done)
+				c.Connect(ctx)
+			}()
+			test.Device(device, cancel)
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for Connect to return")
+			}
+			if c.CloseReason() != test.Reason {
+				t.Fatalf("expected close reason %s actual = %s", test.Reason, c.CloseReason())
+			}
+		})
+	}
+}
+
+//TestSend fails if a command isn't written to the device as a command frame, or if the device's acknowledgement isn't
+//passed to the manager instead of being decoded as a reading
+func TestSend(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lis.Close()
+	m := newManager()
+	m.acks = make(chan client.Ack, 1)
+	device, conn := pipe(t, lis)
+	defer device.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, _ := client.NewClient(conn, m, client.WithCommands())
+	if err := c.Send(client.Command{ID: 1, Type: client.CommandReboot}); err != client.ErrNotLoggedIn {
+		t.Fatalf("expected %s actual = %v", client.ErrNotLoggedIn, err)
+	}
+	go c.Connect(ctx)
+	device.Write(testIMEI(1))
+	waitFor(t, time.Second, func() bool { return c.State() == client.StateActive })
+	sent := client.Command{ID: 7, Type: client.CommandSetInterval, Arg: 30}
+	if err := c.Send(sent); err != nil {
+		t.Fatal(err.Error())
+	}
+	//the simulated device acknowledges the command it receives
+	frame := make([]byte, client.CommandFrameLength)
+	device.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(device, frame); err != nil {
+		t.Fatal(err.Error())
+	}
+	var received client.Command
+	if err := received.Decode(frame); err != nil {
+		t.Fatal(err.Error())
+	}
+	if received != sent {
+		t.Fatalf("expected command %+v actual = %+v", sent, received)
+	}
+	device.Write((&client.Ack{ID: received.ID, Status: client.AckOK}).Encode())
+	select {
+	case ack := <-m.acks:
+		if ack.ID != sent.ID || ack.Status != client.AckOK {
+			t.Fatalf("unexpected acknowledgement: %+v", ack)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for acknowledgement")
+	}
+	if metrics := c.Metrics(); metrics.ValidReadings != 0 || metrics.InvalidReadings != (client.FieldCounts{}) {
+		t.Fatalf("expected acknowledgement not to be counted as a reading: %+v", metrics)
+	}
+	disabled, _ := client.NewClient(newMemConn(), m)
+	if err := disabled.Send(sent); err != client.ErrCommandsDisabled {
+		t.Fatalf("expected %s actual = %v", client.ErrCommandsDisabled, err)
+	}
+}
+
+//TestCloseIdempotent fails if closing a connection concurrently doesn't record, log & handle the close exactly once
+func TestCloseIdempotent(t *testing.T) {
+	var (
+		logs         = &lockedBuffer{}
+		m            = newManager()
+		device, conn = net.Pipe()
+		done         = make(chan struct{})
+	)
+	defer device.Close()
+	m.logger = log.New(logs, "", 0)
+	c, _ := client.NewClient(conn, m)
+	go func() {
+		defer close(done)
+		c.Connect(context.Background())
+	}()
+	device.Write(testIMEI(1))
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&m.logins) == 1 })
+	c.Close(client.CloseEvicted)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close(client.CloseBanned)
+		}()
+	}
+	wg.Wait()
+	<-done
+	if c.CloseReason() != client.CloseEvicted {
+		t.Fatalf("expected first close reason to be recorded actual = %s", c.CloseReason())
+	}
+	if count := strings.Count(logs.String(), "closing connection"); count != 1 {
+		t.Fatalf("expected close to be logged once actual = %v: %s", count, logs.String())
+	}
+	if atomic.LoadInt64(&m.done) != 1 {
+		t.Fatalf("expected done handler to be executed once actual = %v", atomic.LoadInt64(&m.done))
+	}
+}
+
+//TestConnectMetrics fails if a connection's traffic & quality metrics aren't tracked
+func TestConnectMetrics(t *testing.T) {
+	var (
+		m      = newManager()
+		conn   = newMemConn()
+		output = &signalWriter{written: make(chan struct{})}
+	)
+	m.output = output
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, _ := client.NewClient(conn, m)
+	go c.Connect(ctx)
+	time.Sleep(10 * time.Millisecond)
+	conn.in <- testIMEI(1)
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		conn.in <- singleEncodedReading
+		<-output.written
+	}
+	invalid, err := (&client.Reading{Temperature: 500}).Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.in <- invalid
+	waitFor(t, time.Second, func() bool { return c.Metrics().InvalidReadings[client.FieldTemperature] == 1 })
+	metrics := c.Metrics()
+	if metrics.RemoteAddr != memAddr.String() || metrics.BytesRead != 15+4*40 || metrics.ValidReadings != 3 {
+		t.Fatalf("unexpected traffic metrics: %+v", metrics)
+	}
+	if metrics.LoginLatency < 10*time.Millisecond || metrics.ConnectedAt.IsZero() || time.Since(metrics.LastSeen) > time.Second {
+		t.Fatalf("unexpected connection times: %+v", metrics)
+	}
+	if metrics.MessageInterval < 10*time.Millisecond || metrics.MessageInterval > time.Second {
+		t.Fatalf("expected message interval of about 20ms actual = %s", metrics.MessageInterval)
+	}
+	bits, err := json.Marshal(metrics.InvalidReadings)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(bits), `"temperature":1`) {
+		t.Fatalf("expected invalid readings keyed by field actual = %s", bits)
+	}
+	//the invalid reading's battery level of 0 is out of range too
+	rejected := client.FieldCounts{client.FieldTemperature: 1, client.FieldBatteryLevel: 1}
+	if metrics.RejectedFields != rejected || metrics.InvalidReadings[client.FieldBatteryLevel] != 0 {
+		t.Fatalf("expected every field out of range to be counted actual = %v", metrics.RejectedFields)
+	}
+}
+
+//TestConnectValidator fails if readings aren't validated against the validator selected for the device once it logs in
+func TestConnectValidator(t *testing.T) {
+	var (
+		m      = newManager()
+		conn   = newMemConn()
+		output = &signalWriter{written: make(chan struct{})}
+	)
+	m.output = output
+	furnace := client.DefaultValidator()
+	furnace.Name = "furnace"
+	furnace.Bounds[client.FieldTemperature] = client.Bound{Min: -300, Max: 1000}
+	selected := make(chan uint64, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, _ := client.NewClient(conn, m, client.WithValidatorSelector(func(imei uint64) *client.Validator {
+		selected <- imei
+		return &furnace
+	}))
+	go c.Connect(ctx)
+	conn.in <- testIMEI(1)
+	hot, _ := (&client.Reading{Temperature: 500, BatteryLevel: 50}).Encode()
+	conn.in <- hot
+	<-output.written
+	if imei := <-selected; imei != c.GetIMEI() {
+		t.Fatalf("expected the validator to be selected for %v actual = %v", c.GetIMEI(), imei)
+	}
+	tooHot, _ := (&client.Reading{Temperature: 1500, BatteryLevel: 50}).Encode()
+	conn.in <- tooHot
+	waitFor(t, time.Second, func() bool { return c.Metrics().InvalidReadings[client.FieldTemperature] == 1 })
+	if metrics := c.Metrics(); metrics.ValidReadings != 1 {
+		t.Fatalf("expected 1 valid reading actual = %v", metrics.ValidReadings)
+	}
+}
+
+//TestConnectV2 fails if a v2 device isn't served in either ingest mode, or if sequence gaps, duplicate & corrupt
+//frames, clock skew or an invalid frame header aren't detected
+func TestConnectV2(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lis.Close()
+	//the device's clock is an hour ahead of the server's
+	sent := time.Now().Add(time.Hour)
+	frame := func(seq uint32) []byte {
+		return (&client.Reading{Temperature: 21, BatteryLevel: 50}).EncodeFrame(seq, sent)
+	}
+	corrupt := frame(6)
+	corrupt[client.FrameHeaderLength] ^= 0xFF
+	stream := append([]byte{client.ProtocolV2}, testIMEI(1)...)
+	for _, b := range [][]byte{frame(1), frame(2), frame(2), frame(5), corrupt, frame(7)} {
+		stream = append(stream, b...)
+	}
+	for _, mode := range []string{"goroutine", "epoll"} {
+		t.Run(mode, func(t *testing.T) {
+			m := newManager()
+			device, conn := pipe(t, lis)
+			defer device.Close()
+			c, _ := client.NewClient(conn, m)
+			if mode == "goroutine" {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go c.Connect(ctx)
+			} else {
+				poller, err := client.NewPoller(1)
+				if err != nil {
+					t.Skipf("poller unsupported: %s", err)
+				}
+				defer poller.Close()
+				if err := poller.Add(c, nil); err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+			//write the stream in chunks that split the login, headers & payloads
+			for i := 0; i < len(stream); i += 7 {
+				end := i + 7
+				if end > len(stream) {
+					end = len(stream)
+				}
+				if _, err := device.Write(stream[i:end]); err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+			waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&m.readings) == 4 })
+			metrics := c.Metrics()
+			if metrics.Protocol != client.ProtocolV2 || metrics.ValidReadings != 4 {
+				t.Fatalf("expected 4 v2 readings actual = %+v", metrics)
+			}
+			//frames 3 & 4 were never sent, frame 6 was corrupt
+			if metrics.SequenceGaps != 3 || metrics.DuplicateFrames != 1 || metrics.CorruptFrames != 1 {
+				t.Fatalf("unexpected sequence metrics: %+v", metrics)
+			}
+			if skew := metrics.ClockSkew - time.Hour; skew < -time.Second || skew > time.Second {
+				t.Fatalf("expected clock skew of about an hour actual = %s", metrics.ClockSkew)
+			}
+			m.mu.Lock()
+			last := m.last
+			m.mu.Unlock()
+			if last.Seq != 7 || last.DeviceTime.UnixNano()/int64(time.Millisecond) != sent.UnixNano()/int64(time.Millisecond) {
+				t.Fatalf("expected the reading's sequence number & device time to be set: %+v", last)
+			}
+			//an invalid header desynchronizes the stream, so the connection is closed
+			header := frame(8)
+			header[0] = client.ProtocolV1
+			device.Write(header)
+			waitFor(t, time.Second, func() bool { return c.State() == client.StateClosed })
+			if c.CloseReason() != client.CloseProtocolError {
+				t.Fatalf("expected close reason %s actual = %s", client.CloseProtocolError, c.CloseReason())
+			}
+		})
+	}
+}
+
+//TestConnectBatch fails if the readings of a batch frame aren't validated individually & handled in the order they were
+//taken, stamped with the time they were taken
+func TestConnectBatch(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lis.Close()
+	now := time.Now()
+	taken := func(minutes int) time.Time { return now.Add(time.Duration(minutes) * time.Minute) }
+	//the readings are sent out of order & the third one is invalid
+	backlog := []client.Reading{
+		{Temperature: 2, BatteryLevel: 50, DeviceTime: taken(-2)},
+		{Temperature: 1, BatteryLevel: 50, DeviceTime: taken(-3)},
+		{Temperature: 1000, BatteryLevel: 50, DeviceTime: taken(-4)},
+		{Temperature: 3, BatteryLevel: 50, DeviceTime: taken(-1)},
+	}
+	batch, err := client.EncodeBatchFrame(backlog, 2, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	live := (&client.Reading{Temperature: 4, BatteryLevel: 50}).EncodeFrame(3, now)
+	stream := append([]byte{client.ProtocolV2}, testIMEI(1)...)
+	stream = append(append(stream, batch...), live...)
+	for _, mode := range []string{"goroutine", "epoll"} {
+		t.Run(mode, func(t *testing.T) {
+			m := newManager()
+			output := &lockedBuffer{}
+			m.output = output
+			device, conn := pipe(t, lis)
+			defer device.Close()
+			c, _ := client.NewClient(conn, m)
+			if mode == "goroutine" {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go c.Connect(ctx)
+			} else {
+				poller, err := client.NewPoller(1)
+				if err != nil {
+					t.Skipf("poller unsupported: %s", err)
+				}
+				defer poller.Close()
+				if err := poller.Add(c, nil); err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+			//write the stream in chunks that split the batch's readings
+			for i := 0; i < len(stream); i += 100 {
+				end := i + 100
+				if end > len(stream) {
+					end = len(stream)
+				}
+				if _, err := device.Write(stream[i:end]); err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+			waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&m.readings) == 4 })
+			metrics := c.Metrics()
+			if metrics.ValidReadings != 4 || metrics.InvalidReadings[client.FieldTemperature] != 1 || metrics.BackfilledReadings != 4 {
+				t.Fatalf("unexpected metrics: %+v", metrics)
+			}
+			var expected string
+			for _, r := range []client.Reading{backlog[1], backlog[0], backlog[3]} {
+				expected += fmt.Sprintf("%v,%v,%v,0,0,0,50\n", r.DeviceTime.UnixNano()/int64(time.Millisecond)*int64(time.Millisecond), c.GetIMEI(), r.Temperature)
+			}
+			//the live reading is stamped with the time it was received
+			actual := output.String()
+			if !strings.HasPrefix(actual, expected) || !strings.HasSuffix(actual, fmt.Sprintf(",%v,4,0,0,0,50\n", c.GetIMEI())) {
+				t.Fatalf("expected records:\n%s\nactual:\n%s", expected, actual)
+			}
+			m.mu.Lock()
+			last := m.last
+			m.mu.Unlock()
+			if last.Backfilled || last.Seq != 3 {
+				t.Fatalf("expected the live reading to reset the backfilled flag: %+v", last)
+			}
+		})
+	}
+}
+
+//TestPoller fails if a polled connection doesn't log in, decode fragmented readings or time out
+func TestPoller(t *testing.T) {
+	poller, err := client.NewPoller(2)
+	if err != nil {
+		t.Skipf("poller unsupported: %s", err)
+	}
+	defer poller.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lis.Close()
+	m := newManager()
+	device, conn := pipe(t, lis)
+	defer device.Close()
+	c, _ := client.NewClient(conn, m, client.WithReadTimeout(200*time.Millisecond))
+	var done int64
+	if err := poller.Add(c, func() { atomic.AddInt64(&done, 1) }); err != nil {
+		t.Fatal(err.Error())
+	}
+	stream := append(testIMEI(1), singleEncodedReading...)
+	stream = append(stream, singleEncodedReading...)
+	//write the login & readings one byte at a time
+	for i := range stream {
+		if _, err := device.Write(stream[i : i+1]); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&m.readings) == 2 })
+	if c.GetIMEI() == 0 {
+		t.Fatal("expected client to be logged in")
+	}
+	//the connection is closed once no reading is received within the read timeout
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&done) == 1 })
+	if atomic.LoadInt64(&m.done) != 1 {
+		t.Fatal("expected done handler to be executed")
+	}
+	if c.State() != client.StateClosed || c.StateEntered(client.StateIdleWarning).IsZero() {
+		t.Fatalf("expected connection to be closed after an idle warning actual = %s", c.State())
+	}
+	if c.CloseReason() != client.CloseIdleTimeout {
+		t.Fatalf("expected close reason %s actual = %s", client.CloseIdleTimeout, c.CloseReason())
+	}
+}
+
+// go test -bench=Ingest -benchmem ./internal/client (single cpu host, throughput is bound by the device writes)
+// BenchmarkIngest/mode=goroutine/connections=1000           101275             10191 ns/op               0 B/op          0 allocs/op
+//
+//	client_test.go:982: 1000 connections: 10182 bytes per connection
+//
+// BenchmarkIngest/mode=goroutine/connections=5000            92151             12176 ns/op               0 B/op          0 allocs/op
+//
+//	client_test.go:982: 5000 connections: 7769 bytes per connection
+//
+// BenchmarkIngest/mode=epoll/connections=1000               118963              8894 ns/op               0 B/op          0 allocs/op
+//
+//	client_test.go:982: 1000 connections: 2007 bytes per connection
+//
+// BenchmarkIngest/mode=epoll/connections=5000                80043             16302 ns/op               0 B/op          0 allocs/op
+//
+//	client_test.go:982: 5000 connections: 1930 bytes per connection
+//
+//Bytes per connection include both ends of the loopback connection. The 100000 connection step targets a node's
+//fleet: it needs 2 file descriptors per connection(ulimit -n 210000) and is skipped once the benchmark runs out of
+//them, ex: on the host above, whose limit is 20000.
+func BenchmarkIngest(b *testing.B) {
+	for _, mode := range []string{"goroutine", "epoll"} {
+		for _, connections := range []int{1000, 5000, 100000} {
+			b.Run(fmt.Sprintf("mode=%s/connections=%v", mode, connections), func(b *testing.B) {
+				benchmarkIngest(b, mode, connections)
+			})
+		}
+	}
+}
+
+func benchmarkIngest(b *testing.B, mode string, connections int) {
+	var poller *client.Poller
+	if mode == "epoll" {
+		var err error
+		if poller, err = client.NewPoller(0); err != nil {
+			b.Skipf("poller unsupported: %s", err)
+		}
+		defer poller.Close()
+	}
+	var listeners ingestListeners
+	defer listeners.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		m       = newManager()
+		devices = make([]net.Conn, connections)
+		before  runtime.MemStats
+		after   runtime.MemStats
+	)
+	//devices are closed by the deferred cleanup if the benchmark is skipped mid setup
+	defer func() {
+		for _, device := range devices {
+			if device != nil {
+				device.Close()
+			}
+		}
+	}()
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := range devices {
+		device, conn, err := listeners.dial(i)
+		if err != nil {
+			b.Skipf("%v connections: %s", connections, err)
+		}
+		devices[i] = device
+		c, _ := client.NewClient(conn, m, client.WithLoginTimeout(time.Minute), client.WithReadTimeout(time.Minute))
+		if poller != nil {
+			if err := poller.Add(c, nil); err != nil {
+				b.Fatal(err.Error())
+			}
+		} else {
+			go c.Connect(ctx)
+		}
+		if _, err := device.Write(testIMEI(i)); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	waitFor(b, 10*time.Second, func() bool { return atomic.LoadInt64(&m.logins) == int64(connections) })
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	reading := singleEncodedReading
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := devices[i%connections].Write(reading); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	waitFor(b, time.Minute, func() bool { return atomic.LoadInt64(&m.readings) == int64(b.N) })
+	b.StopTimer()
+	inUse := func(m *runtime.MemStats) uint64 { return m.HeapInuse + m.StackInuse }
+	b.Logf("%v connections: %v bytes per connection", connections, (inUse(&after)-inUse(&before))/uint64(connections))
+	if poller != nil {
+		poller.Close()
+	}
+	cancel()
+	for _, device := range devices {
+		device.Close()
+	}
+	waitFor(b, time.Minute, func() bool { return atomic.LoadInt64(&m.done) == int64(connections) })
+}
+
+//ingestConnsPerListener is how many devices BenchmarkIngest connects to each listener, below the 28232 ephemeral ports
+//linux allots to each destination by default
+const ingestConnsPerListener = 20000
+
+//ingestListeners are the listeners of BenchmarkIngest. Each listens on its own loopback address, so the benchmark
+//isn't bound by the ephemeral ports of a single destination
+type ingestListeners []net.Listener
+
+//dial connects the i-th device & returns both ends of its connection
+func (l *ingestListeners) dial(i int) (net.Conn, net.Conn, error) {
+	n := i / ingestConnsPerListener
+	if n == len(*l) {
+		lis, err := net.Listen("tcp", fmt.Sprintf("127.0.0.%v:0", 1+n))
+		if err != nil {
+			return nil, nil, err
+		}
+		*l = append(*l, lis)
+	}
+	lis := (*l)[n]
+	device, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := lis.Accept()
+	if err != nil {
+		device.Close()
+		return nil, nil, err
+	}
+	return device, conn, nil
+}
+
+func (l ingestListeners) Close() {
+	for _, lis := range l {
+		lis.Close()
+	}
+}
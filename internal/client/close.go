@@ -0,0 +1,122 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+//CloseReason is why a client connection was closed
+type CloseReason int32
+
+const (
+	//CloseLoginTimeout is a connection that didn't send its login message within the login timeout
+	CloseLoginTimeout CloseReason = iota + 1
+	//CloseInvalidIMEI is a connection whose login message wasn't a valid imei
+	CloseInvalidIMEI
+	//CloseLoginRejected is a connection whose login was rejected by the login handler, ex: a duplicate login
+	CloseLoginRejected
+	//CloseIdleTimeout is a logged in connection that didn't send a reading within the read timeout
+	CloseIdleTimeout
+	//ClosePeerEOF is a connection that was closed by the device
+	ClosePeerEOF
+	//CloseReadError is a connection that failed to be read
+	CloseReadError
+	//CloseServerShutdown is a connection closed because the server is shutting down
+	CloseServerShutdown
+	//CloseEvicted is a connection closed because the same device logged in on another connection
+	CloseEvicted
+	//CloseBanned is a connection closed because the device isn't allowed to connect
+	CloseBanned
+	//CloseInvalidReadings is a connection closed for violating its InvalidReadingPolicy
+	CloseInvalidReadings
+	//CloseProtocolError is a v2 connection closed because a frame header was invalid, so the stream can't be decoded
+	CloseProtocolError
+)
+
+var closeReasonNames = [...]string{
+	CloseLoginTimeout:    "login_timeout",
+	CloseInvalidIMEI:     "invalid_imei",
+	CloseLoginRejected:   "login_rejected",
+	CloseIdleTimeout:     "idle_timeout",
+	ClosePeerEOF:         "peer_eof",
+	CloseReadError:       "read_error",
+	CloseServerShutdown:  "server_shutdown",
+	CloseEvicted:         "evicted",
+	CloseBanned:          "banned",
+	CloseInvalidReadings: "invalid_readings",
+	CloseProtocolError:   "protocol_error",
+}
+
+//String returns the name of the reason, ex: peer_eof
+func (r CloseReason) String() string {
+	if r <= 0 || int(r) >= len(closeReasonNames) {
+		return "none"
+	}
+	return closeReasonNames[r]
+}
+
+//CloseError is an error that closes the connection for the given reason. A LoginHandler may return a CloseError to
+//choose the reason its connection is closed with, otherwise the reason is CloseLoginRejected
+type CloseError struct {
+	Reason CloseReason
+	Err    error
+}
+
+func (e *CloseError) Error() string {
+	return e.Err.Error()
+}
+
+//readCloseReason returns the reason a connection whose read failed with err is closed. timeout is the reason for a
+//read that timed out
+func readCloseReason(err error, timeout CloseReason) CloseReason {
+	if closeErr, ok := err.(*CloseError); ok {
+		return closeErr.Reason
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return timeout
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ClosePeerEOF
+	}
+	return CloseReadError
+}
+
+//loginCloseReason returns the reason a connection whose login handler failed with err is closed
+func loginCloseReason(err error) CloseReason {
+	if closeErr, ok := err.(*CloseError); ok {
+		return closeErr.Reason
+	}
+	return CloseLoginRejected
+}
+
+//CloseReason returns why the connection was closed, or zero if it hasn't been
+func (c *client) CloseReason() CloseReason {
+	return CloseReason(atomic.LoadInt32(&c.reason))
+}
+
+//markClosed records the reason the connection is closed, logs it & stops Connect. Only the first call returns true,
+//later calls are ignored
+func (c *client) markClosed(reason CloseReason) bool {
+	if !atomic.CompareAndSwapInt32(&c.reason, 0, int32(reason)) {
+		return false
+	}
+	c.manager.GetServerLogger().Printf("[INFO] %v closing connection: %s", c.GetIMEI(), reason)
+	c.setState(StateClosing)
+	close(c.close)
+	return true
+}
+
+//Close closes the connection for the given reason. It may be called from any goroutine any number of times(ex: when
+//the client is evicted), only the first reason is recorded
+func (c *client) Close(reason CloseReason) {
+	if !c.markClosed(reason) {
+		return
+	}
+	if c.detach != nil {
+		c.detach()
+		return
+	}
+	//closing the connection unblocks any pending read
+	c.conn.Close()
+}
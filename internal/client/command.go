@@ -0,0 +1,194 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//CommandFrameLength is the length of a command frame written to a device:
+//
+//	bytes 0-1   CommandMagic
+//	byte  2     CommandType
+//	byte  3     reserved(zero)
+//	bytes 4-7   command id, big endian
+//	bytes 8-11  argument, big endian(ex: the interval in seconds of CommandSetInterval)
+//	bytes 12-15 reserved(zero)
+const CommandFrameLength = 16
+
+//CommandMagic starts every command frame
+var CommandMagic = [2]byte{'T', 'C'}
+
+//AckMagic starts every acknowledgement frame sent by a device. Acknowledgements are sent in place of a reading, so
+//their first 8 bytes are a NaN temperature that can never be a valid reading:
+//
+//	bytes 0-7   AckMagic, big endian
+//	bytes 8-11  command id, big endian
+//	byte  12    AckStatus
+//	bytes 13-39 reserved(zero)
+const AckMagic uint64 = 0x7FF800000041434B
+
+var (
+	//ErrCommandsDisabled is returned by Send if the client wasn't created with WithCommands
+	ErrCommandsDisabled = errors.New("commands disabled")
+	//ErrNotLoggedIn is returned by Send if the device hasn't logged in yet
+	ErrNotLoggedIn = errors.New("device not logged in")
+)
+
+//CommandType is the type of a command sent to a device
+type CommandType uint8
+
+const (
+	//CommandSetInterval sets the device's reporting interval to Arg seconds
+	CommandSetInterval CommandType = iota + 1
+	//CommandRequestStatus asks the device to acknowledge with its status
+	CommandRequestStatus
+	//CommandReboot reboots the device
+	CommandReboot
+)
+
+var commandTypeNames = [...]string{
+	CommandSetInterval:   "set_interval",
+	CommandRequestStatus: "request_status",
+	CommandReboot:        "reboot",
+}
+
+//Valid reports whether the command type is a known command
+func (t CommandType) Valid() bool {
+	return int(t) < len(commandTypeNames) && commandTypeNames[t] != ""
+}
+
+func (t CommandType) String() string {
+	if t.Valid() {
+		return commandTypeNames[t]
+	}
+	return fmt.Sprintf("command(%d)", uint8(t))
+}
+
+//MarshalText encodes the command type as its name
+func (t CommandType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+//UnmarshalText decodes a command type from its name
+func (t *CommandType) UnmarshalText(b []byte) error {
+	for i, name := range commandTypeNames {
+		if name != "" && name == string(b) {
+			*t = CommandType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown command type: %q", b)
+}
+
+//Command is a command sent to a device
+type Command struct {
+	ID   uint32
+	Type CommandType
+	Arg  uint32
+}
+
+//Encode encodes the command to a command frame
+func (cmd *Command) Encode() []byte {
+	b := make([]byte, CommandFrameLength)
+	b[0], b[1] = CommandMagic[0], CommandMagic[1]
+	b[2] = byte(cmd.Type)
+	binary.BigEndian.PutUint32(b[4:8], cmd.ID)
+	binary.BigEndian.PutUint32(b[8:12], cmd.Arg)
+	return b
+}
+
+//Decode decodes a command frame into cmd
+func (cmd *Command) Decode(b []byte) error {
+	if len(b) < CommandFrameLength || b[0] != CommandMagic[0] || b[1] != CommandMagic[1] {
+		return errors.New("invalid command frame")
+	}
+	cmd.Type = CommandType(b[2])
+	cmd.ID = binary.BigEndian.Uint32(b[4:8])
+	cmd.Arg = binary.BigEndian.Uint32(b[8:12])
+	return nil
+}
+
+//AckStatus is a device's response to a command
+type AckStatus uint8
+
+const (
+	//AckOK means the device executed the command
+	AckOK AckStatus = iota
+	//AckUnsupported means the device doesn't support the command
+	AckUnsupported
+	//AckFailed means the device failed to execute the command
+	AckFailed
+)
+
+func (s AckStatus) String() string {
+	switch s {
+	case AckOK:
+		return "ok"
+	case AckUnsupported:
+		return "unsupported"
+	case AckFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("status(%d)", uint8(s))
+}
+
+//Ack is a device's acknowledgement of a command
+type Ack struct {
+	ID     uint32
+	Status AckStatus
+}
+
+//Encode encodes the acknowledgement to an acknowledgement frame
+func (a *Ack) Encode() []byte {
+	b := make([]byte, 40)
+	binary.BigEndian.PutUint64(b[0:8], AckMagic)
+	binary.BigEndian.PutUint32(b[8:12], a.ID)
+	b[12] = byte(a.Status)
+	return b
+}
+
+//isAck reports whether the message b is an acknowledgement frame
+func isAck(b []byte) bool {
+	return len(b) >= 40 && binary.BigEndian.Uint64(b[0:8]) == AckMagic
+}
+
+//Decode decodes an acknowledgement frame into a
+func (a *Ack) Decode(b []byte) error {
+	if !isAck(b) {
+		return errors.New("invalid acknowledgement frame")
+	}
+	a.ID = binary.BigEndian.Uint32(b[8:12])
+	a.Status = AckStatus(b[12])
+	return nil
+}
+
+//CommandObserver is notified of command acknowledgements sent by devices
+type CommandObserver interface {
+	CommandAcked(c ClientConn, ack Ack)
+}
+
+//Send writes the command to the device. Send is safe to call from any goroutine, and returns an error if the device
+//hasn't logged in, the connection is closed or the write doesn't complete within the write timeout
+func (c *client) Send(cmd Command) error {
+	if !c.commands {
+		return ErrCommandsDisabled
+	}
+	if c.GetIMEI() == 0 {
+		return ErrNotLoggedIn
+	}
+	if reason := c.CloseReason(); reason != 0 {
+		return fmt.Errorf("connection closed: %s", reason)
+	}
+	frame := cmd.Encode()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return fmt.Errorf("send command: %s", err)
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		return fmt.Errorf("send command: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/common"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+)
+
+//Protocol versions. A v1 device logs in with its 15 digit imei & sends bare 40 byte readings. A v2 device logs in
+//with the ProtocolV2 byte followed by its imei & sends v2 frames. The first byte of a login message is always an
+//ascii digit for v1 devices, so the version is negotiated by the login message alone.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+)
+
+//v2 frames are made of a header, a payload & a checksum:
+//
+//	byte  0     version(ProtocolV2)
+//	byte  1     FrameType
+//	bytes 2-3   payload length, big endian
+//	bytes 4-7   sequence number, big endian. The device increments it for every frame it sends
+//	bytes 8-15  when the device sent the frame in unix milliseconds, big endian
+//	...         payload
+//	last 4      crc32(ieee) of the header & payload, big endian
+const (
+	FrameHeaderLength   = 16
+	FrameChecksumLength = 4
+	//LoginV2Length is the length of a v2 login message
+	LoginV2Length = 1 + common.MinImeiLength
+	//BatchEntryLength is the length of each reading in a batch frame: when the reading was taken in unix milliseconds,
+	//big endian, followed by the 40 byte reading
+	BatchEntryLength = 8 + common.MinReadingLength
+	//MaxBatchReadings is the most readings a batch frame may hold
+	MaxBatchReadings = 256
+	//readingFrameLength is the length of a reading or acknowledgement frame
+	readingFrameLength = FrameHeaderLength + common.MinReadingLength + FrameChecksumLength
+	//maxFramePayload is the largest payload of any frame type
+	maxFramePayload = MaxBatchReadings * BatchEntryLength
+	//maxFrameLength is the largest message a device may send
+	maxFrameLength = FrameHeaderLength + maxFramePayload + FrameChecksumLength
+)
+
+//FrameType is the type of a v2 frame's payload
+type FrameType uint8
+
+const (
+	//FrameReading is a frame whose payload is a 40 byte reading
+	FrameReading FrameType = iota + 1
+	//FrameAck is a frame whose payload is a 40 byte acknowledgement(see Ack)
+	FrameAck
+	//FrameBatch is a frame whose payload is up to MaxBatchReadings readings the device buffered while it was offline,
+	//each BatchEntryLength bytes long
+	FrameBatch
+)
+
+var (
+	//ErrFrameHeader is returned when decoding a frame with an unsupported version, type or payload length. The frame's
+	//length can't be trusted, so the rest of the stream can't be decoded either
+	ErrFrameHeader = errors.New("invalid frame header")
+	//ErrFrameChecksum is returned when decoding a frame whose checksum doesn't match its contents
+	ErrFrameChecksum = errors.New("frame checksum mismatch")
+)
+
+//FrameHeader is the header of a v2 frame
+type FrameHeader struct {
+	Version uint8
+	Type    FrameType
+	Length  uint16
+	Seq     uint32
+	//DeviceTime is when the device sent the frame in unix milliseconds
+	DeviceTime int64
+}
+
+//Decode decodes the header at the start of b into h. It returns ErrFrameHeader if the header is invalid, and panics
+//if b isn't at least FrameHeaderLength bytes long.
+//
+//Decode does NOT allocate under any condition.
+func (h *FrameHeader) Decode(b []byte) error {
+	h.Version = b[0]
+	h.Type = FrameType(b[1])
+	h.Length = binary.BigEndian.Uint16(b[2:4])
+	h.Seq = binary.BigEndian.Uint32(b[4:8])
+	h.DeviceTime = int64(binary.BigEndian.Uint64(b[8:16]))
+	if h.Version != ProtocolV2 {
+		return ErrFrameHeader
+	}
+	switch h.Type {
+	case FrameReading, FrameAck:
+		if h.Length != common.MinReadingLength {
+			return ErrFrameHeader
+		}
+	case FrameBatch:
+		if h.Length == 0 || h.Length%BatchEntryLength != 0 || h.Length > maxFramePayload {
+			return ErrFrameHeader
+		}
+	default:
+		return ErrFrameHeader
+	}
+	return nil
+}
+
+//FrameLength returns the length of the whole frame
+func (h *FrameHeader) FrameLength() int {
+	return FrameHeaderLength + int(h.Length) + FrameChecksumLength
+}
+
+//appendFrame appends a frame with the given header & payload to dst
+func appendFrame(dst []byte, typ FrameType, seq uint32, sent time.Time, payload []byte) []byte {
+	start := len(dst)
+	var header [FrameHeaderLength]byte
+	header[0] = ProtocolV2
+	header[1] = byte(typ)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], seq)
+	binary.BigEndian.PutUint64(header[8:16], uint64(sent.UnixNano()/int64(time.Millisecond)))
+	dst = append(dst, header[:]...)
+	dst = append(dst, payload...)
+	var sum [FrameChecksumLength]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(dst[start:]))
+	return append(dst, sum[:]...)
+}
+
+//verifyFrame checks the checksum of the complete frame b
+func verifyFrame(b []byte) error {
+	n := len(b) - FrameChecksumLength
+	if crc32.ChecksumIEEE(b[:n]) != binary.BigEndian.Uint32(b[n:]) {
+		return ErrFrameChecksum
+	}
+	return nil
+}
+
+//EncodeFrame encodes the reading to a v2 reading frame with the given sequence number & send time
+func (r *Reading) EncodeFrame(seq uint32, sent time.Time) []byte {
+	var payload [common.MinReadingLength]byte
+	r.EncodeTo(&payload)
+	return appendFrame(make([]byte, 0, readingFrameLength), FrameReading, seq, sent, payload[:])
+}
+
+//EncodeBatchFrame encodes readings to a v2 batch frame with the given sequence number & send time. Each reading is
+//stamped with its DeviceTime, which should be when the device took it
+func EncodeBatchFrame(readings []Reading, seq uint32, sent time.Time) ([]byte, error) {
+	if len(readings) == 0 || len(readings) > MaxBatchReadings {
+		return nil, fmt.Errorf("a batch frame holds 1 to %v readings, got %v", MaxBatchReadings, len(readings))
+	}
+	payload := make([]byte, 0, len(readings)*BatchEntryLength)
+	for i := range readings {
+		var taken [8]byte
+		binary.BigEndian.PutUint64(taken[:], uint64(readings[i].DeviceTime.UnixNano()/int64(time.Millisecond)))
+		payload = readings[i].AppendBinary(append(payload, taken[:]...))
+	}
+	return appendFrame(make([]byte, 0, FrameHeaderLength+len(payload)+FrameChecksumLength), FrameBatch, seq, sent, payload), nil
+}
+
+//DecodeFrame decodes the v2 reading frame b into r, setting the reading's sequence number & device time.
+//
+//If the frame is corrupt ErrFrameHeader or ErrFrameChecksum is returned & r is left unchanged. Otherwise the reading
+//is validated as it is by Decode.
+//
+//DecodeFrame does NOT allocate unless the reading is invalid.
+func (r *Reading) DecodeFrame(b []byte) (bool, error) {
+	if len(b) < FrameHeaderLength {
+		return false, ErrFrameHeader
+	}
+	var h FrameHeader
+	if err := h.Decode(b); err != nil || h.Type != FrameReading || len(b) != h.FrameLength() {
+		return false, ErrFrameHeader
+	}
+	if err := verifyFrame(b); err != nil {
+		return false, err
+	}
+	ok, err := r.Decode(b[FrameHeaderLength : FrameHeaderLength+int(h.Length)])
+	r.Seq = h.Seq
+	r.DeviceTime = time.Unix(0, h.DeviceTime*int64(time.Millisecond))
+	return ok, err
+}
+
+//EncodeFrame encodes the acknowledgement to a v2 acknowledgement frame
+func (a *Ack) EncodeFrame(seq uint32, sent time.Time) []byte {
+	return appendFrame(make([]byte, 0, readingFrameLength), FrameAck, seq, sent, a.Encode())
+}
+
+//frameSize returns the length of the next message given its first buffered bytes. If the length can't be known
+//yet, the number of bytes needed to know it is returned. An error is returned for an invalid v2 frame header
+func (c *client) frameSize(buffered []byte) (int, error) {
+	switch {
+	case c.GetIMEI() == 0:
+		if len(buffered) == 0 {
+			return 1, nil
+		}
+		if buffered[0] == ProtocolV2 {
+			return LoginV2Length, nil
+		}
+		return common.MinImeiLength, nil
+	case c.protocol == ProtocolV1:
+		return common.MinReadingLength, nil
+	case len(buffered) < FrameHeaderLength:
+		return FrameHeaderLength, nil
+	}
+	var h FrameHeader
+	if err := h.Decode(buffered); err != nil {
+		return 0, fmt.Errorf("%s: version %v type %v length %v", err, h.Version, h.Type, h.Length)
+	}
+	return h.FrameLength(), nil
+}
+
+//loginMessage negotiates the protocol version from the login message b & logs the client in
+func (c *client) loginMessage(b []byte) error {
+	if b[0] == ProtocolV2 {
+		c.protocol = ProtocolV2
+		b = b[1:]
+	}
+	atomic.StoreInt32(&c.metrics.protocol, int32(c.protocol))
+	if err := c.handleLogin(c, b); err != nil {
+		return err
+	}
+	if c.selectValidator != nil {
+		if v := c.selectValidator(c.GetIMEI()); v != nil {
+			c.validator = v
+		}
+	}
+	return nil
+}
+
+//observeFrame tracks the sequence number & clock skew of a v2 frame received at now. It reports whether the frame is
+//a duplicate(its sequence number isn't after the last one), which should be dropped. It does NOT allocate unless a
+//gap or duplicate is found
+func (c *client) observeFrame(h *FrameHeader, now time.Time) bool {
+	m := &c.metrics
+	skew := h.DeviceTime*int64(time.Millisecond) - now.UnixNano()
+	if m.frames++; m.frames == 1 {
+		atomic.StoreInt64(&m.skew, skew)
+		m.seq = h.Seq
+		return false
+	}
+	current := atomic.LoadInt64(&m.skew)
+	atomic.StoreInt64(&m.skew, current+(skew-current)/intervalWeight)
+	//sequence numbers are compared with serial number arithmetic so they may wrap around
+	switch delta := int32(h.Seq - m.seq); {
+	case delta <= 0:
+		atomic.AddUint64(&m.duplicates, 1)
+		c.manager.GetServerLogger().Printf("[WARN] %v duplicate frame: sequence %v after %v", c.GetIMEI(), h.Seq, m.seq)
+		return true
+	case delta > 1:
+		atomic.AddUint64(&m.gaps, uint64(delta-1))
+		c.manager.GetServerLogger().Printf("[WARN] %v sequence gap: %v frame(s) missed between %v & %v", c.GetIMEI(), delta-1, m.seq, h.Seq)
+	}
+	m.seq = h.Seq
+	return false
+}
+
+//handleFrame verifies a v2 frame & handles its payload
+func (c *client) handleFrame(b []byte) {
+	var h FrameHeader
+	if err := h.Decode(b); err != nil {
+		return
+	}
+	if err := verifyFrame(b); err != nil {
+		atomic.AddUint64(&c.metrics.corrupt, 1)
+		c.handleErr(c, fmt.Errorf("decode frame %v: %s", h.Seq, err))
+		return
+	}
+	if c.observeFrame(&h, time.Now()) {
+		return
+	}
+	payload := b[FrameHeaderLength : FrameHeaderLength+int(h.Length)]
+	switch h.Type {
+	case FrameAck:
+		if c.commands && isAck(payload) {
+			c.handleAck(payload)
+		}
+	case FrameReading:
+		invalid := c.decode(payload)
+		c.reading.Seq = h.Seq
+		c.reading.DeviceTime = time.Unix(0, h.DeviceTime*int64(time.Millisecond))
+		c.handleDecoded(invalid)
+	case FrameBatch:
+		c.handleBatch(&h, payload)
+	}
+}
+
+//batchEntry is a reading of a batch frame: when it was taken in unix milliseconds & its offset in the payload
+type batchEntry struct {
+	taken  int64
+	offset int
+}
+
+//handleBatch validates & handles each reading of a batch frame's payload in the order they were taken. Backfilled
+//readings are stamped with the time they were taken instead of when they were received. It does NOT allocate once
+//the client has handled a batch of the same size
+func (c *client) handleBatch(h *FrameHeader, payload []byte) {
+	entries := c.batch[:0]
+	for offset := 0; offset < len(payload); offset += BatchEntryLength {
+		entries = append(entries, batchEntry{
+			taken:  int64(binary.BigEndian.Uint64(payload[offset : offset+8])),
+			offset: offset + 8,
+		})
+	}
+	c.batch = entries
+	//devices usually buffer readings in order, so an insertion sort is cheap & keeps readings taken at the same time in order
+	for i := 1; i < len(entries); i++ {
+		for j := i; j > 0 && entries[j].taken < entries[j-1].taken; j-- {
+			entries[j], entries[j-1] = entries[j-1], entries[j]
+		}
+	}
+	c.manager.GetServerLogger().Printf("[INFO] %v backfilling %v reading(s)", c.GetIMEI(), len(entries))
+	for _, e := range entries {
+		invalid := c.decode(payload[e.offset : e.offset+common.MinReadingLength])
+		c.reading.Seq = h.Seq
+		c.reading.DeviceTime = time.Unix(0, e.taken*int64(time.Millisecond))
+		c.reading.Timestamp = c.reading.DeviceTime
+		c.reading.Backfilled = true
+		if c.handleDecoded(invalid); c.CloseReason() != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+//frameReaderSize is the initial buffer size of a frameReader. It fits several coalesced reading messages. The buffer
+//is allocated by the first read, so connections served by a Poller never allocate it
+const frameReaderSize = 512
+
+//frameReader reads whole messages off of a byte stream regardless of how the stream was fragmented or coalesced by
+//the network. Bytes following a message are buffered for the next one.
+type frameReader struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	//read counts every byte read from the stream, it's updated atomically
+	read *uint64
+}
+
+func newFrameReader(r io.Reader, read *uint64) frameReader {
+	return frameReader{
+		r:    r,
+		read: read,
+	}
+}
+
+//buffered returns the number of bytes read from the stream that haven't been returned yet
+func (f *frameReader) buffered() int {
+	return f.end - f.start
+}
+
+//fill reads from the stream once, first making room for an n byte message at the end of the buffer
+func (f *frameReader) fill(n int) error {
+	if len(f.buf)-f.start < n {
+		if n > len(f.buf) {
+			size := n
+			if size < frameReaderSize {
+				size = frameReaderSize
+			}
+			buf := make([]byte, size)
+			f.end = copy(buf, f.buf[f.start:f.end])
+			f.buf = buf
+		} else {
+			f.end = copy(f.buf, f.buf[f.start:f.end])
+		}
+		f.start = 0
+	}
+	read, err := f.r.Read(f.buf[f.end:])
+	f.end += read
+	if read > 0 {
+		atomic.AddUint64(f.read, uint64(read))
+	}
+	return err
+}
+
+//peek returns the next n bytes without consuming them. The returned slice is only valid until the next call to peek or
+//next. Errors are returned as they are by next
+func (f *frameReader) peek(n int) ([]byte, error) {
+	for f.buffered() < n {
+		if err := f.fill(n); err != nil {
+			if f.buffered() >= n {
+				break
+			}
+			if err == io.EOF && f.buffered() > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return f.buf[f.start : f.start+n], nil
+}
+
+//next returns the next n byte message. The returned slice is only valid until the next call to next.
+//
+//If the stream ends before the message is complete, the returned error is io.ErrUnexpectedEOF. If the read fails
+//for any other reason(ex: a timeout) the partial message stays buffered, so next may be called again.
+//
+//next does NOT allocate unless n is larger than any previous message.
+func (f *frameReader) next(n int) ([]byte, error) {
+	b, err := f.peek(n)
+	if err != nil {
+		return nil, err
+	}
+	f.start += n
+	if f.start == f.end {
+		f.start, f.end = 0, 0
+	}
+	return b, nil
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+//FieldCounts counts readings by field. It's written as a json object keyed by field name
+type FieldCounts [numFields]uint64
+
+//MarshalJSON encodes the counts as a json object keyed by field name
+func (f FieldCounts) MarshalJSON() ([]byte, error) {
+	counts := make(map[string]uint64, numFields)
+	for field, count := range f {
+		counts[Field(field).String()] = count
+	}
+	return json.Marshal(counts)
+}
+
+//Metrics holds the traffic & quality metrics of a client connection
+type Metrics struct {
+	//RemoteAddr is the address the device connected from
+	RemoteAddr string `json:"remoteAddr"`
+	//ConnectedAt is when the connection was accepted
+	ConnectedAt time.Time `json:"connectedAt"`
+	//LoginLatency is how long the device took to log in after connecting. Zero until the device has logged in
+	LoginLatency time.Duration `json:"loginLatency"`
+	//BytesRead is the number of bytes read from the connection
+	BytesRead uint64 `json:"bytesRead"`
+	//ValidReadings is the number of readings that passed validation
+	ValidReadings uint64 `json:"validReadings"`
+	//InvalidReadings counts the readings that failed validation by the first field that was out of range
+	InvalidReadings FieldCounts `json:"invalidReadings"`
+	//RejectedFields counts every field that was out of range, so a reading with several is counted by each of them
+	RejectedFields FieldCounts `json:"rejectedFields"`
+	//LastSeen is when the last complete message was received
+	LastSeen time.Time `json:"lastSeen"`
+	//MessageInterval is the moving average of the time between readings. Zero until two readings have been received
+	MessageInterval time.Duration `json:"messageInterval"`
+	//Protocol is the protocol version negotiated at login. Zero until the device has logged in
+	Protocol int `json:"protocol"`
+	//SequenceGaps is the number of v2 frames missed according to their sequence numbers
+	SequenceGaps uint64 `json:"sequenceGaps"`
+	//DuplicateFrames is the number of v2 frames dropped since their sequence number wasn't after the previous frame's
+	DuplicateFrames uint64 `json:"duplicateFrames"`
+	//CorruptFrames is the number of v2 frames dropped since their checksum didn't match
+	CorruptFrames uint64 `json:"corruptFrames"`
+	//ClockSkew is the moving average of the device's clock minus the server's clock when v2 frames are received
+	ClockSkew time.Duration `json:"clockSkew"`
+	//BackfilledReadings is the number of readings received in v2 batch frames, valid or not
+	BackfilledReadings uint64 `json:"backfilledReadings"`
+}
+
+//metrics are updated by the goroutine serving the connection and read atomically by others
+type metrics struct {
+	bytesRead uint64
+	valid     uint64
+	invalid   FieldCounts
+	rejected  FieldCounts
+	//loginLatency, lastSeen & interval are in nanoseconds
+	loginLatency int64
+	lastSeen     int64
+	interval     int64
+	protocol     int32
+	gaps         uint64
+	duplicates   uint64
+	corrupt      uint64
+	backfilled   uint64
+	//skew is in nanoseconds
+	skew int64
+	//readings, frames & seq are only accessed by the goroutine serving the connection
+	readings uint64
+	frames   uint64
+	seq      uint32
+}
+
+//intervalWeight is the weight of the latest interval in the moving average of the message interval
+const intervalWeight = 8
+
+//Metrics returns a snapshot of the connection's metrics. It may be called from any goroutine
+func (c *client) Metrics() Metrics {
+	m := Metrics{
+		ConnectedAt:        c.StateEntered(StateAccepted),
+		LoginLatency:       time.Duration(atomic.LoadInt64(&c.metrics.loginLatency)),
+		BytesRead:          atomic.LoadUint64(&c.metrics.bytesRead),
+		ValidReadings:      atomic.LoadUint64(&c.metrics.valid),
+		MessageInterval:    time.Duration(atomic.LoadInt64(&c.metrics.interval)),
+		Protocol:           int(atomic.LoadInt32(&c.metrics.protocol)),
+		SequenceGaps:       atomic.LoadUint64(&c.metrics.gaps),
+		DuplicateFrames:    atomic.LoadUint64(&c.metrics.duplicates),
+		CorruptFrames:      atomic.LoadUint64(&c.metrics.corrupt),
+		ClockSkew:          time.Duration(atomic.LoadInt64(&c.metrics.skew)),
+		BackfilledReadings: atomic.LoadUint64(&c.metrics.backfilled),
+	}
+	if addr := c.conn.RemoteAddr(); addr != nil {
+		m.RemoteAddr = addr.String()
+	}
+	for field := range m.InvalidReadings {
+		m.InvalidReadings[field] = atomic.LoadUint64(&c.metrics.invalid[field])
+		m.RejectedFields[field] = atomic.LoadUint64(&c.metrics.rejected[field])
+	}
+	if lastSeen := atomic.LoadInt64(&c.metrics.lastSeen); lastSeen != 0 {
+		m.LastSeen = time.Unix(0, lastSeen)
+	}
+	return m
+}
+
+//observeLogin records the login latency of the connection
+func (c *client) observeLogin(now time.Time) {
+	atomic.StoreInt64(&c.metrics.loginLatency, int64(now.Sub(c.StateEntered(StateAccepted))))
+	atomic.StoreInt64(&c.metrics.lastSeen, now.UnixNano())
+}
+
+//observeValidity counts a reading as valid, or by the fields that are out of range if invalid isn't nil. It does NOT
+//allocate
+func (c *client) observeValidity(invalid *ValidationError) {
+	if invalid == nil {
+		atomic.AddUint64(&c.metrics.valid, 1)
+		return
+	}
+	atomic.AddUint64(&c.metrics.invalid[invalid.Fields[0].Field], 1)
+	for _, f := range invalid.Fields {
+		atomic.AddUint64(&c.metrics.rejected[f.Field], 1)
+	}
+}
+
+//observeReading records a reading and the interval since the previous one. invalid is the reading's validation error,
+//nil if it is valid. It does NOT allocate
+func (c *client) observeReading(now time.Time, invalid *ValidationError) {
+	c.observeValidity(invalid)
+	//the first reading's interval would include the login, so it only marks when the reading was seen
+	last := atomic.SwapInt64(&c.metrics.lastSeen, now.UnixNano())
+	if c.metrics.readings++; c.metrics.readings < 2 {
+		return
+	}
+	sample := now.UnixNano() - last
+	interval := atomic.LoadInt64(&c.metrics.interval)
+	if interval == 0 {
+		interval = sample
+	} else {
+		interval += (sample - interval) / intervalWeight
+	}
+	atomic.StoreInt64(&c.metrics.interval, interval)
+}
+
+//observeBackfill records a backfilled reading. Backfilled readings arrive in bursts long after they were taken, so they
+//don't affect when the device was last seen or its message interval. It does NOT allocate
+func (c *client) observeBackfill(invalid *ValidationError) {
+	atomic.AddUint64(&c.metrics.backfilled, 1)
+	c.observeValidity(invalid)
+}
@@ -0,0 +1,117 @@
+package client
+
+import "time"
+
+//Option configures a client created by NewClient
+type Option func(c *client)
+
+//WithLoginTimeout sets how long the client has to send its login message before the connection is dropped(default: 1s)
+func WithLoginTimeout(timeout time.Duration) Option {
+	return func(c *client) {
+		c.loginTimeout = timeout
+	}
+}
+
+//WithReadTimeout sets how long the client may go without sending a reading before the connection is dropped(default: 2s)
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(c *client) {
+		c.readTimeout = timeout
+	}
+}
+
+//WithWriteTimeout sets how long a command may take to be written to the connection(default: 1s)
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(c *client) {
+		c.writeTimeout = timeout
+	}
+}
+
+//WithCommands enables the command downlink: Send writes commands to the device & acknowledgement frames sent by the
+//device are passed to the manager instead of being decoded as readings(default: disabled)
+func WithCommands() Option {
+	return func(c *client) {
+		c.commands = true
+	}
+}
+
+//WithInvalidReadingPolicy closes the connection with CloseInvalidReadings once it violates the policy(default: never)
+func WithInvalidReadingPolicy(policy InvalidReadingPolicy) Option {
+	return func(c *client) {
+		c.invalidPolicy = policy
+	}
+}
+
+//WithValidator validates the client's readings with v(default: DefaultValidator)
+func WithValidator(v Validator) Option {
+	return func(c *client) {
+		c.validator = &v
+	}
+}
+
+//WithValidatorSelector validates the client's readings with the validator selected for its imei once it has logged in,
+//ex: by the device's TAC. A nil validator keeps the client's validator
+func WithValidatorSelector(selector func(imei uint64) *Validator) Option {
+	return func(c *client) {
+		c.selectValidator = selector
+	}
+}
+
+//WithErrorHandler replaces the handler of errors during the lifecycle of the connection(default: logs the error to the
+//server logger)
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(c *client) {
+		c.handleErr = handler
+	}
+}
+
+//WrapErrorHandler wraps the current error handler, ex: to count errors before they're logged
+func WrapErrorHandler(wrap func(next ErrorHandler) ErrorHandler) Option {
+	return func(c *client) {
+		c.handleErr = wrap(c.handleErr)
+	}
+}
+
+//WithLoginHandler replaces the login handler(default: decodes the imei & adds the client to the manager)
+func WithLoginHandler(handler LoginHandler) Option {
+	return func(c *client) {
+		c.handleLogin = handler
+	}
+}
+
+//WrapLoginHandler wraps the current login handler, ex: to only allow known devices to log in
+func WrapLoginHandler(wrap func(next LoginHandler) LoginHandler) Option {
+	return func(c *client) {
+		c.handleLogin = wrap(c.handleLogin)
+	}
+}
+
+//WithReadingHandler replaces the final reading handler that runs after every reading middleware(default: writes the
+//reading record to the reading output & caches the reading)
+func WithReadingHandler(handler ReadingHandler) Option {
+	return func(c *client) {
+		c.handleReading = handler
+	}
+}
+
+//WithReadingMiddleware appends middleware to the client's reading middleware stack. Middleware runs in the order it's
+//added, regardless of where WithReadingHandler appears in the options
+func WithReadingMiddleware(middleware ...ReadingMiddleware) Option {
+	return func(c *client) {
+		c.middleware = append(c.middleware, middleware...)
+	}
+}
+
+//WithDoneHandler replaces the handler executed once a logged in client's connection is closing(default: removes the
+//client from the manager)
+func WithDoneHandler(handler DoneHandler) Option {
+	return func(c *client) {
+		c.handleDone = handler
+	}
+}
+
+//WrapDoneHandler wraps the current done handler
+func WrapDoneHandler(wrap func(next DoneHandler) DoneHandler) Option {
+	return func(c *client) {
+		c.handleDone = wrap(c.handleDone)
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+//MaxInvalidWindow is the largest number of readings an InvalidReadingPolicy may measure its invalid ratio over
+const MaxInvalidWindow = 64
+
+//InvalidReadingPolicy disconnects devices that keep sending readings that fail validation. A zero value never
+//disconnects
+type InvalidReadingPolicy struct {
+	//MaxConsecutive is the number of consecutive invalid readings that disconnects the device. Zero disables the check
+	MaxConsecutive int
+	//Window is the number of most recent readings the invalid ratio is measured over, at most MaxInvalidWindow
+	Window int
+	//MaxRatio disconnects the device once the ratio of invalid readings within a full window exceeds it. Zero disables
+	//the check
+	MaxRatio float64
+}
+
+//invalidReadings tracks the validity of a connection's recent readings
+type invalidReadings struct {
+	consecutive int
+	//window has a bit set for each invalid reading, the latest reading is the lowest bit
+	window uint64
+	seen   int
+}
+
+//checkReading records whether the latest reading was valid and returns an error if the connection violates its
+//invalid reading policy. It does NOT allocate unless the policy is violated
+func (c *client) checkReading(valid bool) error {
+	p, r := &c.invalidPolicy, &c.invalid
+	if p.MaxConsecutive <= 0 && p.MaxRatio <= 0 {
+		return nil
+	}
+	r.window <<= 1
+	if valid {
+		r.consecutive = 0
+	} else {
+		r.consecutive++
+		r.window |= 1
+	}
+	if r.seen < p.Window {
+		r.seen++
+	}
+	if p.MaxConsecutive > 0 && r.consecutive >= p.MaxConsecutive {
+		return fmt.Errorf("%v consecutive invalid readings", r.consecutive)
+	}
+	if p.MaxRatio > 0 && p.Window > 0 && r.seen == p.Window {
+		mask := ^uint64(0)
+		if p.Window < MaxInvalidWindow {
+			mask = 1<<uint(p.Window) - 1
+		}
+		invalid := bits.OnesCount64(r.window & mask)
+		if ratio := float64(invalid) / float64(p.Window); ratio > p.MaxRatio {
+			return fmt.Errorf("%v of the last %v readings were invalid", invalid, p.Window)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//pollInterval bounds how long a worker waits for events before checking connection deadlines
+const pollInterval = 100 * time.Millisecond
+
+//Poller services client connections from a small pool of epoll workers instead of a goroutine per connection. A
+//polled connection costs a fixed size frame buffer instead of a goroutine stack, and enforces the same login & read
+//timeouts as Connect.
+type Poller struct {
+	workers []*pollWorker
+	next    uint32
+	closed  int32
+	wg      sync.WaitGroup
+}
+
+//NewPoller starts a poller with the given number of workers. Zero workers defaults to the number of cpus
+func NewPoller(workers int) (*Poller, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	p := &Poller{}
+	for i := 0; i < workers; i++ {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("poller: epoll create: %s", err)
+		}
+		w := &pollWorker{
+			poller: p,
+			epfd:   epfd,
+			conns:  map[int]*polledConn{},
+		}
+		w.read = func(fd uintptr) bool {
+			w.n, w.err = syscall.Read(int(fd), w.buf[:])
+			//never wait for the descriptor to be readable, the worker's epoll instance does
+			return true
+		}
+		p.workers = append(p.workers, w)
+	}
+	for _, w := range p.workers {
+		p.wg.Add(1)
+		go w.run()
+	}
+	return p, nil
+}
+
+//Add hands the connection of c to the poller, which serves it until it is closed. done is called once the
+//connection has been closed. c must have been created by NewClient and must not be Connected. If c can't be added it
+//is marked closed, but its connection is left for the caller to close.
+func (p *Poller) Add(c ClientConn, done func()) error {
+	cl, ok := c.(*client)
+	if !ok {
+		return fmt.Errorf("poller: unsupported client connection %T", c)
+	}
+	err := p.add(cl, done)
+	if err != nil {
+		reason := CloseReadError
+		if atomic.LoadInt32(&p.closed) == 1 {
+			reason = CloseServerShutdown
+		}
+		cl.markClosed(reason)
+		cl.setState(StateClosed)
+	}
+	return err
+}
+
+func (p *Poller) add(cl *client, done func()) error {
+	sc, ok := cl.conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("poller: %T doesn't expose a file descriptor", cl.conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("poller: %s", err)
+	}
+	//fd only identifies the connection in the worker's epoll set, every syscall on it goes through raw so the
+	//runtime, which owns the descriptor, can't close it mid-call
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return fmt.Errorf("poller: %s", err)
+	}
+	w := p.workers[atomic.AddUint32(&p.next, 1)%uint32(len(p.workers))]
+	return w.add(&polledConn{
+		c:        cl,
+		raw:      raw,
+		fd:       fd,
+		done:     done,
+		deadline: time.Now().Add(cl.loginTimeout).UnixNano(),
+	})
+}
+
+//Close stops the poller's workers and closes every connection it serves
+func (p *Poller) Close() {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return
+	}
+	p.wg.Wait()
+	for _, w := range p.workers {
+		w.mu.Lock()
+		w.closed = true
+		conns := make([]*polledConn, 0, len(w.conns))
+		for _, pc := range w.conns {
+			conns = append(conns, pc)
+		}
+		w.mu.Unlock()
+		for _, pc := range conns {
+			w.remove(pc, CloseServerShutdown)
+		}
+		syscall.Close(w.epfd)
+	}
+}
+
+//pollWorker waits for events on the connections registered with its epoll instance. Only the worker's goroutine
+//reads from, times out or closes its connections.
+type pollWorker struct {
+	poller *Poller
+	epfd   int
+	mu     sync.Mutex
+	conns  map[int]*polledConn
+	closed bool
+	//buf is shared by every connection serviced by the worker
+	buf [16 << 10]byte
+	//read reads from a connection's descriptor into buf, storing the result in n & err. It's created once so reading
+	//through a connection's RawConn doesn't allocate
+	read func(fd uintptr) bool
+	n    int
+	err  error
+}
+
+//polledConn is a connection served by a pollWorker
+type polledConn struct {
+	c    *client
+	raw  syscall.RawConn
+	fd   int
+	done func()
+	//frame holds a partially received message. large, borrowed from largeFrames, replaces it while a message that
+	//doesn't fit(a batch frame) is received, so a polled connection only pays for the largest frame while it's sending
+	//one
+	frame [readingFrameLength]byte
+	large *[maxFrameLength]byte
+	n     int
+	//idle is when the connection enters StateIdleWarning & deadline is when it times out in unix nanoseconds
+	idle     int64
+	deadline int64
+}
+
+func (w *pollWorker) add(pc *polledConn) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errors.New("poller: closed")
+	}
+	//shutting the socket down wakes the worker with an EOF, so the connection is always removed by its worker
+	pc.c.detach = func() {
+		pc.raw.Control(func(fd uintptr) {
+			syscall.Shutdown(int(fd), syscall.SHUT_RDWR)
+		})
+	}
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(pc.fd)}
+	var err error
+	if cerr := pc.raw.Control(func(fd uintptr) {
+		err = syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_ADD, int(fd), &event)
+	}); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		pc.c.detach = nil
+		return fmt.Errorf("poller: epoll add: %s", err)
+	}
+	w.conns[pc.fd] = pc
+	return nil
+}
+
+//remove closes the connection for the given reason, unless it was already closed with another one. handleDone is
+//only executed for connections that logged in successfully
+func (w *pollWorker) remove(pc *polledConn, reason CloseReason) {
+	w.mu.Lock()
+	if w.conns[pc.fd] == pc {
+		delete(w.conns, pc.fd)
+		//a descriptor that was already closed has left the epoll set
+		pc.raw.Control(func(fd uintptr) {
+			syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+		})
+	}
+	w.mu.Unlock()
+	pc.release()
+	pc.c.markClosed(reason)
+	pc.c.conn.Close()
+	//only logged in connections have been active
+	if !pc.c.StateEntered(StateActive).IsZero() {
+		pc.c.handleDone(pc.c)
+	}
+	pc.c.setState(StateClosed)
+	if pc.done != nil {
+		pc.done()
+	}
+}
+
+func (w *pollWorker) run() {
+	defer w.poller.wg.Done()
+	var (
+		events    [128]syscall.EpollEvent
+		lastSweep = time.Now()
+	)
+	for atomic.LoadInt32(&w.poller.closed) == 0 {
+		n, err := syscall.EpollWait(w.epfd, events[:], int(pollInterval/time.Millisecond))
+		if err != nil && err != syscall.EINTR {
+			return
+		}
+		for i := 0; i < n; i++ {
+			w.mu.Lock()
+			pc := w.conns[int(events[i].Fd)]
+			w.mu.Unlock()
+			if pc != nil {
+				w.service(pc)
+			}
+		}
+		if now := time.Now(); now.Sub(lastSweep) >= pollInterval {
+			w.sweep(now)
+			lastSweep = now
+		}
+	}
+}
+
+//service reads whatever is available on the connection
+func (w *pollWorker) service(pc *polledConn) {
+	w.n, w.err = 0, nil
+	if err := pc.raw.Read(w.read); err != nil {
+		w.err = err
+	}
+	n, err := w.n, w.err
+	switch {
+	case err == syscall.EAGAIN || err == syscall.EINTR:
+	case err != nil:
+		if pc.c.CloseReason() == 0 {
+			pc.c.handleErr(pc.c, fmt.Errorf("failed to read message: %s", err))
+		}
+		w.remove(pc, CloseReadError)
+	case n == 0:
+		if pc.n > 0 && pc.c.CloseReason() == 0 {
+			size, _ := pc.c.frameSize(pc.buffer()[:pc.n])
+			pc.c.handleErr(pc.c, fmt.Errorf("connection closed mid-message: received %v of %v bytes", pc.n, size))
+		}
+		w.remove(pc, ClosePeerEOF)
+	default:
+		atomic.AddUint64(&pc.c.metrics.bytesRead, uint64(n))
+		w.feed(pc, w.buf[:n])
+	}
+}
+
+//feed splits b into login, reading & v2 frame messages, buffering any trailing partial message
+func (w *pollWorker) feed(pc *polledConn, b []byte) {
+	if pc.c.GetIMEI() == 0 {
+		pc.c.setState(StateAuthenticating)
+	}
+	for len(b) > 0 && pc.c.CloseReason() == 0 {
+		size, err := pc.c.frameSize(pc.buffer()[:pc.n])
+		if err != nil {
+			pc.c.handleErr(pc.c, err)
+			w.remove(pc, CloseProtocolError)
+			return
+		}
+		n := copy(pc.grow(size)[pc.n:size], b)
+		pc.n += n
+		b = b[n:]
+		if pc.n < size {
+			return
+		}
+		//the message's length is only known once its first bytes have been buffered
+		if size, err = pc.c.frameSize(pc.buffer()[:pc.n]); err != nil {
+			pc.c.handleErr(pc.c, err)
+			w.remove(pc, CloseProtocolError)
+			return
+		}
+		if size > pc.n {
+			continue
+		}
+		message := pc.buffer()[:size]
+		pc.n = 0
+		if pc.c.GetIMEI() == 0 {
+			if err := pc.c.loginMessage(message); err != nil {
+				pc.c.handleErr(pc.c, fmt.Errorf("client login: %s", err))
+				w.remove(pc, loginCloseReason(err))
+				return
+			}
+			pc.c.observeLogin(time.Now())
+			pc.c.setState(StateActive)
+		} else {
+			pc.c.setState(StateActive)
+			pc.c.handleMessage(message)
+			pc.release()
+		}
+		now := time.Now()
+		pc.idle = now.Add(pc.c.readTimeout / 2).UnixNano()
+		pc.deadline = now.Add(pc.c.readTimeout).UnixNano()
+	}
+}
+
+//buffer returns the buffer holding the partially received message
+func (pc *polledConn) buffer() []byte {
+	if pc.large != nil {
+		return pc.large[:]
+	}
+	return pc.frame[:]
+}
+
+//largeFrames holds the buffers of messages that don't fit a polled connection's frame buffer, so connections share
+//them instead of each keeping one after receiving a batch frame
+var largeFrames = sync.Pool{
+	New: func() interface{} {
+		return new([maxFrameLength]byte)
+	},
+}
+
+//grow returns a buffer that can hold a message of the given size
+func (pc *polledConn) grow(size int) []byte {
+	if size > len(pc.frame) && pc.large == nil {
+		pc.large = largeFrames.Get().(*[maxFrameLength]byte)
+		copy(pc.large[:], pc.frame[:pc.n])
+	}
+	return pc.buffer()
+}
+
+//release returns the large message buffer to the pool once the message has been handled
+func (pc *polledConn) release() {
+	if pc.large != nil {
+		largeFrames.Put(pc.large)
+		pc.large = nil
+	}
+}
+
+//sweep closes every connection that has passed its deadline & warns of idle connections
+func (w *pollWorker) sweep(now time.Time) {
+	var expired, idle []*polledConn
+	w.mu.Lock()
+	for _, pc := range w.conns {
+		if pc.deadline < now.UnixNano() {
+			expired = append(expired, pc)
+		} else if pc.idle != 0 && pc.idle < now.UnixNano() {
+			idle = append(idle, pc)
+		}
+	}
+	w.mu.Unlock()
+	for _, pc := range idle {
+		pc.c.setState(StateIdleWarning)
+	}
+	for _, pc := range expired {
+		if pc.c.GetIMEI() == 0 {
+			pc.c.handleErr(pc.c, errors.New("client login: timeout"))
+			w.remove(pc, CloseLoginTimeout)
+			continue
+		}
+		pc.c.handleErr(pc.c, errors.New("client timeout: no reading received"))
+		w.remove(pc, CloseIdleTimeout)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import "errors"
+
+var errPollerUnsupported = errors.New("poller: epoll is only supported on linux")
+
+//Poller services client connections from a small pool of epoll workers instead of a goroutine per connection. It is
+//only supported on linux.
+type Poller struct{}
+
+//NewPoller always returns an error on platforms without epoll
+func NewPoller(workers int) (*Poller, error) {
+	return nil, errPollerUnsupported
+}
+
+//Add always returns an error on platforms without epoll
+func (p *Poller) Add(c ClientConn, done func()) error {
+	return errPollerUnsupported
+}
+
+//Close is a no-op on platforms without epoll
+func (p *Poller) Close() {}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/autom8ter/thermomatic/internal/common"
 	"math"
+	"strconv"
 	"time"
 )
 
@@ -26,41 +27,68 @@ type Reading struct {
 	BatteryLevel float64 `json:"batteryLevel"`
 
 	Timestamp time.Time `json:"timestamp"`
+
+	// Seq is the sequence number of the v2 frame the reading was sent in. Zero for v1 readings.
+	Seq uint32 `json:"seq,omitempty"`
+
+	// DeviceTime is when the device sent the reading, or took it if the reading is backfilled. Zero for v1 readings.
+	DeviceTime time.Time `json:"deviceTime"`
+
+	// Backfilled is set for readings the device buffered while offline & sent in a batch frame once it reconnected.
+	// Backfilled readings are stamped with the time they were taken instead of when they were received.
+	Backfilled bool `json:"backfilled,omitempty"`
 }
 
-//String returns a human readable string
+//String returns the reading's csv record(see AppendCSV)
 func (r *Reading) String(imei uint64) string {
-	return fmt.Sprintf(`%v,%v,%v,%v,%v,%v,%v\n`, time.Now().Unix(), imei, r.Temperature, r.Altitude, r.Latitude, r.Longitude, r.BatteryLevel)
+	return string(r.AppendCSV(nil, imei))
+}
+
+//Field is a reading field that is validated
+type Field int
+
+const (
+	FieldTemperature Field = iota
+	FieldAltitude
+	FieldLatitude
+	FieldLongitude
+	FieldBatteryLevel
+)
+
+//numFields is the number of validated reading fields
+const numFields = int(FieldBatteryLevel) + 1
 
+var fieldNames = [numFields]string{
+	FieldTemperature:  "temperature",
+	FieldAltitude:     "altitude",
+	FieldLatitude:     "latitude",
+	FieldLongitude:    "longitude",
+	FieldBatteryLevel: "batteryLevel",
 }
 
-//validate returns true with no error if the reading is valid. it also returns an error message if the reading is invalid
-func (r *Reading) validate() (bool, error) {
-	if r.Temperature < -300 || r.Temperature > 300 {
-		return false, common.Wrap(common.ErrReadingTemp, fmt.Sprintf("value: %v", r.Temperature))
+//String returns the json name of the field, ex: batteryLevel
+func (f Field) String() string {
+	if f < 0 || int(f) >= numFields {
+		return "unknown"
 	}
-	if r.BatteryLevel < 0 || r.BatteryLevel > 100 {
-		return false, common.Wrap(common.ErrReadingBattery, fmt.Sprintf("value: %v", r.BatteryLevel))
-	}
-	if r.Altitude < -20000 || r.Altitude > 20000 {
-		return false, common.Wrap(common.ErrReadingAlt, fmt.Sprintf("value: %v", r.Altitude))
-	}
-	if r.Latitude < -90 || r.Latitude > 90 {
-		return false, common.Wrap(common.ErrReadingLat, fmt.Sprintf("value: %v", r.Latitude))
-	}
-	if r.Longitude < -180 || r.Longitude > 180 {
-		return false, common.Wrap(common.ErrReadingLon, fmt.Sprintf("value: %v", r.Longitude))
-	}
-	return true, nil
+	return fieldNames[f]
 }
 
 // Decode decodes the reading message payload in the given b into r.
 //
-// If any of the fields are outside their valid min/max ranges ok will be unset.
+// If any of the fields are outside their valid min/max ranges ok will be unset & err is a
+// *ValidationError listing every field that is out of range.
+// Fields are validated against the protocol specification(see DefaultValidator).
 //
-// Decode does NOT allocate under any condition. Additionally, it panics if b
+// Decode does NOT allocate unless the reading is invalid. Additionally, it panics if b
 // isn't at least 40 bytes long.
 func (r *Reading) Decode(b []byte) (bool, error) {
+	r.decode(b)
+	return defaultValidator.Validate(r)
+}
+
+//decode decodes the reading message payload in b into r without validating it
+func (r *Reading) decode(b []byte) {
 	if len(b) < common.MinReadingLength {
 		panic(common.Wrap(common.ErrInvalidImei, fmt.Sprintf("invalid imei: %s", string(b))))
 	}
@@ -70,29 +98,81 @@ func (r *Reading) Decode(b []byte) (bool, error) {
 	r.Longitude = math.Float64frombits(binary.BigEndian.Uint64(b[24:32]))
 	r.BatteryLevel = math.Float64frombits(binary.BigEndian.Uint64(b[32:40]))
 	r.Timestamp = time.Now()
-	return r.validate()
+	r.Seq, r.DeviceTime, r.Backfilled = 0, time.Time{}, false
 }
 
-//Log uses the provided logger to log the reading as a human readable string
+//Log uses the provided logger to log the reading's csv record. It's meant for debugging, the reading output is written
+//with AppendCSV
 func (r *Reading) Log(code uint64, logger Printer) {
-	logger.Printf("record = %s", r.String(code))
+	logger.Printf("%s", r.String(code))
+}
+
+//AppendCSV appends the reading's csv record to dst and returns the extended buffer:
+//
+//	timestamp,imei,temperature,altitude,latitude,longitude,batteryLevel\n
+//
+//The timestamp is when the reading was received(see Decode), or taken if it is backfilled, in nanoseconds since the
+//unix epoch. Values are written with the fewest digits that represent them exactly & never in exponent form.
+//
+//AppendCSV does NOT allocate if dst has enough capacity for the record.
+func (r *Reading) AppendCSV(dst []byte, imei uint64) []byte {
+	dst = strconv.AppendInt(dst, r.Timestamp.UnixNano(), 10)
+	dst = append(dst, ',')
+	dst = strconv.AppendUint(dst, imei, 10)
+	dst = append(dst, ',')
+	dst = strconv.AppendFloat(dst, r.Temperature, 'f', -1, 64)
+	dst = append(dst, ',')
+	dst = strconv.AppendFloat(dst, r.Altitude, 'f', -1, 64)
+	dst = append(dst, ',')
+	dst = strconv.AppendFloat(dst, r.Latitude, 'f', -1, 64)
+	dst = append(dst, ',')
+	dst = strconv.AppendFloat(dst, r.Longitude, 'f', -1, 64)
+	dst = append(dst, ',')
+	dst = strconv.AppendFloat(dst, r.BatteryLevel, 'f', -1, 64)
+	return append(dst, '\n')
 }
 
-//Encode encodes a reading to a byteslice
+//Encode encodes a reading to a byteslice.
+//
+//Deprecated: Encode never returns an error & allocates the returned slice, use AppendBinary or EncodeTo instead.
 func (r *Reading) Encode() ([]byte, error) {
-	var (
-		body  = make([]byte, 0, 40)
-		field = make([]byte, 8)
-	)
-	binary.BigEndian.PutUint64(field, math.Float64bits(r.Temperature))
-	body = append(body, field...)
-	binary.BigEndian.PutUint64(field, math.Float64bits(r.Altitude))
-	body = append(body, field...)
-	binary.BigEndian.PutUint64(field, math.Float64bits(r.Latitude))
-	body = append(body, field...)
-	binary.BigEndian.PutUint64(field, math.Float64bits(r.Longitude))
-	body = append(body, field...)
-	binary.BigEndian.PutUint64(field, math.Float64bits(r.BatteryLevel))
-	body = append(body, field...)
-	return body, nil
+	return r.AppendBinary(make([]byte, 0, common.MinReadingLength)), nil
+}
+
+//EncodeTo encodes the reading's 40 byte payload message into b. The reading isn't validated.
+//
+//EncodeTo does NOT allocate under any condition.
+func (r *Reading) EncodeTo(b *[common.MinReadingLength]byte) {
+	binary.BigEndian.PutUint64(b[0:8], math.Float64bits(r.Temperature))
+	binary.BigEndian.PutUint64(b[8:16], math.Float64bits(r.Altitude))
+	binary.BigEndian.PutUint64(b[16:24], math.Float64bits(r.Latitude))
+	binary.BigEndian.PutUint64(b[24:32], math.Float64bits(r.Longitude))
+	binary.BigEndian.PutUint64(b[32:40], math.Float64bits(r.BatteryLevel))
+}
+
+//AppendBinary appends the reading's 40 byte payload message to dst and returns the extended buffer(see EncodeTo).
+//
+//AppendBinary does NOT allocate if dst has enough capacity for the message.
+func (r *Reading) AppendBinary(dst []byte) []byte {
+	var b [common.MinReadingLength]byte
+	r.EncodeTo(&b)
+	return append(dst, b[:]...)
+}
+
+//MarshalBinary encodes the reading's 40 byte payload message. It implements encoding.BinaryMarshaler & only allocates
+//the returned slice.
+func (r *Reading) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, common.MinReadingLength)), nil
+}
+
+//UnmarshalBinary decodes the 40 byte payload message b into r. It implements encoding.BinaryUnmarshaler: unlike Decode
+//it returns an error instead of panicking if b isn't 40 bytes long, and an invalid reading is returned as an error.
+//
+//UnmarshalBinary does NOT allocate unless it returns an error.
+func (r *Reading) UnmarshalBinary(b []byte) error {
+	if len(b) != common.MinReadingLength {
+		return common.Wrap(common.ErrReadingBytes, fmt.Sprintf("length: %v", len(b)))
+	}
+	_, err := r.Decode(b)
+	return err
 }
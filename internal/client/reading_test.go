@@ -1,9 +1,17 @@
 package client_test
 
 import (
+	"errors"
+	"fmt"
 	"github.com/autom8ter/thermomatic/internal/client"
+	"github.com/autom8ter/thermomatic/internal/common"
+	"io/ioutil"
 	"log"
+	"math"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -130,6 +138,127 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+//TestValidator fails if the default profile doesn't match the protocol specification's ranges, or if a bound doesn't
+//honor its exclusive flags & reject NaN and ±Inf
+func TestValidator(t *testing.T) {
+	valid := client.Reading{Temperature: 50, Altitude: 5280, Latitude: 39.93, Longitude: -105, BatteryLevel: 95}
+	tests := []struct {
+		Name  string
+		Field client.Field
+		Value float64
+		Pass  bool
+	}{
+		{Name: "min temperature", Field: client.FieldTemperature, Value: -300, Pass: true},
+		{Name: "max temperature", Field: client.FieldTemperature, Value: 300, Pass: true},
+		{Name: "too cold", Field: client.FieldTemperature, Value: math.Nextafter(-300, -400)},
+		{Name: "nan temperature", Field: client.FieldTemperature, Value: math.NaN()},
+		{Name: "max altitude", Field: client.FieldAltitude, Value: 20000, Pass: true},
+		{Name: "+inf altitude", Field: client.FieldAltitude, Value: math.Inf(1)},
+		{Name: "min latitude", Field: client.FieldLatitude, Value: -90, Pass: true},
+		{Name: "-inf latitude", Field: client.FieldLatitude, Value: math.Inf(-1)},
+		{Name: "max longitude", Field: client.FieldLongitude, Value: 180, Pass: true},
+		{Name: "too far east", Field: client.FieldLongitude, Value: 180.5},
+		{Name: "empty battery", Field: client.FieldBatteryLevel, Value: 0},
+		{Name: "almost empty battery", Field: client.FieldBatteryLevel, Value: math.SmallestNonzeroFloat64, Pass: true},
+		{Name: "full battery", Field: client.FieldBatteryLevel, Value: 100, Pass: true},
+		{Name: "nan battery", Field: client.FieldBatteryLevel, Value: math.NaN()},
+	}
+	set := func(r *client.Reading, field client.Field, value float64) {
+		switch field {
+		case client.FieldTemperature:
+			r.Temperature = value
+		case client.FieldAltitude:
+			r.Altitude = value
+		case client.FieldLatitude:
+			r.Latitude = value
+		case client.FieldLongitude:
+			r.Longitude = value
+		case client.FieldBatteryLevel:
+			r.BatteryLevel = value
+		}
+	}
+	validator := client.DefaultValidator()
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := valid
+			set(&r, test.Field, test.Value)
+			ok, err := validator.Validate(&r)
+			if ok != test.Pass {
+				t.Fatalf("expected valid=%v, got %v: %v", test.Pass, ok, err)
+			}
+			if field, invalid := validator.InvalidField(&r); invalid != !test.Pass || (invalid && field != test.Field) {
+				t.Errorf("unexpected invalid field: %s(%v)", field, invalid)
+			}
+			if test.Pass {
+				return
+			}
+			if !strings.Contains(err.Error(), validator.Bounds[test.Field].String()) {
+				t.Errorf("expected the bound in error: %s", err)
+			}
+			//Decode validates against the default profile
+			b := r.AppendBinary(nil)
+			if ok, _ := new(client.Reading).Decode(b); ok {
+				t.Error("expected Decode to reject the reading")
+			}
+		})
+	}
+	if got := validator.Bounds[client.FieldBatteryLevel].String(); got != "(0, 100]" {
+		t.Errorf("unexpected battery level bound: %s", got)
+	}
+	strict := client.Bound{Min: -10, Max: 10, MinExclusive: true, MaxExclusive: true}
+	for value, contained := range map[float64]bool{-10: false, 10: false, 0: true, 9.99: true} {
+		if strict.Contains(value) != contained {
+			t.Errorf("expected %s contains %v to be %v", strict, value, contained)
+		}
+	}
+	for _, bound := range []client.Bound{{Min: 1, Max: 0}, {Min: 1, Max: 1, MaxExclusive: true}, {Min: math.Inf(-1), Max: 0}} {
+		v := client.DefaultValidator()
+		v.Bounds[client.FieldAltitude] = bound
+		if err := v.Check(); err == nil {
+			t.Errorf("expected %s to fail the check", bound)
+		}
+	}
+	//every field out of range is reported & matched by its sentinel error
+	broken := valid
+	broken.Temperature, broken.Latitude, broken.BatteryLevel = 500, math.Inf(1), 0
+	_, err := new(client.Reading).Decode(broken.AppendBinary(nil))
+	var verr *client.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a *client.ValidationError actual = %T", err)
+	}
+	expected := []client.FieldError{
+		{Field: client.FieldTemperature, Value: 500, Bound: validator.Bounds[client.FieldTemperature]},
+		{Field: client.FieldBatteryLevel, Value: 0, Bound: validator.Bounds[client.FieldBatteryLevel]},
+		{Field: client.FieldLatitude, Value: math.Inf(1), Bound: validator.Bounds[client.FieldLatitude]},
+	}
+	if verr.Profile != "default" || fmt.Sprint(verr.Fields) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected validation error: %+v", verr)
+	}
+	if !verr.Has(client.FieldLatitude) || verr.Has(client.FieldAltitude) {
+		t.Errorf("unexpected fields: %s", verr)
+	}
+	for target, matches := range map[error]bool{
+		common.ErrInvalidReading: true,
+		common.ErrReadingTemp:    true,
+		common.ErrReadingLat:     true,
+		common.ErrReadingBattery: true,
+		common.ErrReadingAlt:     false,
+		common.ErrReadingBytes:   false,
+	} {
+		if errors.Is(fmt.Errorf("wrapped: %w", err), target) != matches {
+			t.Errorf("expected errors.Is(%q) to be %v", target, matches)
+		}
+	}
+	const message = "invalid reading - temperature 500 not in [-300, 300], batteryLevel 0 not in (0, 100], latitude +Inf not in [-90, 90] (default profile)"
+	if err.Error() != message {
+		t.Errorf("unexpected error message: %s", err)
+	}
+	allocs := testing.AllocsPerRun(100, func() { validator.Validate(&valid) })
+	if allocs != 0 {
+		t.Errorf("expected Validate not to allocate, got %v allocs", allocs)
+	}
+}
+
 //go test -v -bench=.
 //BenchmarkDecode-12     20000000                75.4 ns/op             0 B/op          0 allocs/op
 func BenchmarkDecode(b *testing.B) {
@@ -139,3 +268,213 @@ func BenchmarkDecode(b *testing.B) {
 		r.Decode(singleEncodedReading)
 	}
 }
+
+//TestBinaryRoundTrip fails if a reading encoded by AppendBinary, EncodeTo, MarshalBinary or Encode doesn't decode to the
+//same reading, or if the encoders & UnmarshalBinary allocate
+func TestBinaryRoundTrip(t *testing.T) {
+	readings := []client.Reading{
+		{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.25666},
+		{Temperature: -300, Altitude: 20000, Latitude: -90, Longitude: 180, BatteryLevel: 100},
+		{Temperature: math.Copysign(0, -1), Altitude: math.SmallestNonzeroFloat64, Latitude: math.Nextafter(90, 0), Longitude: -180, BatteryLevel: 1e-9},
+	}
+	encoders := []struct {
+		Name   string
+		Encode func(r *client.Reading) []byte
+	}{
+		{Name: "AppendBinary", Encode: func(r *client.Reading) []byte { return r.AppendBinary(nil) }},
+		{Name: "EncodeTo", Encode: func(r *client.Reading) []byte {
+			var b [40]byte
+			r.EncodeTo(&b)
+			return b[:]
+		}},
+		{Name: "MarshalBinary", Encode: func(r *client.Reading) []byte {
+			b, _ := r.MarshalBinary()
+			return b
+		}},
+		{Name: "Encode", Encode: func(r *client.Reading) []byte {
+			b, _ := r.Encode()
+			return b
+		}},
+	}
+	for _, encoder := range encoders {
+		t.Run(encoder.Name, func(t *testing.T) {
+			for _, reading := range readings {
+				b := encoder.Encode(&reading)
+				if len(b) != 40 {
+					t.Fatalf("expected 40 bytes actual = %v", len(b))
+				}
+				var decoded, unmarshaled client.Reading
+				if ok, err := decoded.Decode(b); !ok || err != nil {
+					t.Fatalf("failed to decode %+v: %v", reading, err)
+				}
+				if err := unmarshaled.UnmarshalBinary(b); err != nil {
+					t.Fatal(err.Error())
+				}
+				for _, r := range []client.Reading{decoded, unmarshaled} {
+					//compare bits so -0 isn't equal to 0
+					for i, pair := range [][2]float64{
+						{r.Temperature, reading.Temperature},
+						{r.Altitude, reading.Altitude},
+						{r.Latitude, reading.Latitude},
+						{r.Longitude, reading.Longitude},
+						{r.BatteryLevel, reading.BatteryLevel},
+					} {
+						if math.Float64bits(pair[0]) != math.Float64bits(pair[1]) {
+							t.Fatalf("field %v: expected %v actual = %v", i, pair[1], pair[0])
+						}
+					}
+				}
+			}
+		})
+	}
+	reading := &readings[0]
+	var (
+		dst     = make([]byte, 0, 40)
+		payload [40]byte
+		decoded client.Reading
+	)
+	reading.EncodeTo(&payload)
+	tests := map[string]func(){
+		"AppendBinary":    func() { reading.AppendBinary(dst[:0]) },
+		"EncodeTo":        func() { reading.EncodeTo(&payload) },
+		"UnmarshalBinary": func() { decoded.UnmarshalBinary(payload[:]) },
+	}
+	for name, fn := range tests {
+		if allocs := testing.AllocsPerRun(100, fn); allocs != 0 {
+			t.Errorf("expected %s not to allocate actual = %v allocs", name, allocs)
+		}
+	}
+	if err := decoded.UnmarshalBinary(payload[:39]); !errors.Is(err, common.ErrReadingBytes) {
+		t.Errorf("expected UnmarshalBinary to reject a short payload actual = %v", err)
+	}
+}
+
+//go test -bench='Encode|AppendBinary' -benchmem ./internal/client
+//BenchmarkEncode         30156429                34.52 ns/op           48 B/op          1 allocs/op
+//BenchmarkAppendBinary   128852406                9.991 ns/op           0 B/op          0 allocs/op
+func BenchmarkEncode(b *testing.B) {
+	r := &client.Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.25666}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Encode()
+	}
+}
+
+func BenchmarkAppendBinary(b *testing.B) {
+	r := &client.Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.25666}
+	dst := make([]byte, 0, 40)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = r.AppendBinary(dst[:0])
+	}
+}
+
+//TestAppendCSV fails if the csv records of the readings don't match testdata/records.golden, which starts with the
+//README's output format example, or if appending a record allocates
+func TestAppendCSV(t *testing.T) {
+	readings := []struct {
+		IMEI    uint64
+		Reading client.Reading
+	}{
+		{
+			IMEI:    490154203237518,
+			Reading: client.Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.25666, Timestamp: time.Unix(0, 1257894000000000000)},
+		},
+		{
+			IMEI:    450154603277518,
+			Reading: client.Reading{Temperature: -300, Altitude: 20000, Latitude: -90, Longitude: 180, BatteryLevel: 100, Timestamp: time.Unix(1500000000, 1)},
+		},
+		{
+			IMEI:    450154603277518,
+			Reading: client.Reading{Temperature: math.Nextafter(0.3, 1), Altitude: 1e-7, Latitude: 0, Longitude: -0.000001, BatteryLevel: 1.5, Timestamp: time.Unix(0, 0)},
+		},
+	}
+	var actual []byte
+	for _, r := range readings {
+		actual = r.Reading.AppendCSV(actual, r.IMEI)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join("testdata", "records.golden"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(actual) != string(expected) {
+		t.Fatalf("expected records:\n%s\nactual:\n%s", expected, actual)
+	}
+	if record := readings[0].Reading.String(readings[0].IMEI); record != strings.SplitAfter(string(expected), "\n")[0] {
+		t.Fatalf("expected String to return the csv record actual = %q", record)
+	}
+	dst := make([]byte, 0, 128)
+	if allocs := testing.AllocsPerRun(100, func() { readings[0].Reading.AppendCSV(dst[:0], readings[0].IMEI) }); allocs != 0 {
+		t.Fatalf("expected AppendCSV not to allocate actual = %v allocs", allocs)
+	}
+}
+
+//TestDecodeFrame fails if a v2 reading frame doesn't round trip, if a corrupt frame isn't detected or if decoding a
+//frame allocates
+func TestDecodeFrame(t *testing.T) {
+	sent := time.Unix(1500000000, 123*int64(time.Millisecond))
+	reading := &client.Reading{Temperature: 50.77, Altitude: 5280, Latitude: 39.93, Longitude: -105.0, BatteryLevel: 95}
+	frame := reading.EncodeFrame(42, sent)
+	if len(frame) != client.FrameHeaderLength+40+client.FrameChecksumLength {
+		t.Fatalf("unexpected frame length: %v", len(frame))
+	}
+	corrupt := func(i int) []byte {
+		b := append([]byte(nil), frame...)
+		b[i] ^= 0xFF
+		return b
+	}
+	tests := []struct {
+		Name  string
+		Frame []byte
+		Err   error
+	}{
+		{Name: "valid", Frame: frame},
+		{Name: "corrupt payload", Frame: corrupt(client.FrameHeaderLength + 3), Err: client.ErrFrameChecksum},
+		{Name: "corrupt sequence", Frame: corrupt(5), Err: client.ErrFrameChecksum},
+		{Name: "unsupported version", Frame: corrupt(0), Err: client.ErrFrameHeader},
+		{Name: "unsupported type", Frame: corrupt(1), Err: client.ErrFrameHeader},
+		{Name: "truncated", Frame: frame[:len(frame)-1], Err: client.ErrFrameHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var decoded client.Reading
+			ok, err := decoded.DecodeFrame(test.Frame)
+			if err != test.Err {
+				t.Fatalf("expected error %v actual = %v", test.Err, err)
+			}
+			if test.Err != nil {
+				return
+			}
+			if !ok || decoded.Seq != 42 || !decoded.DeviceTime.Equal(sent) || decoded.Temperature != reading.Temperature {
+				t.Fatalf("unexpected decoded reading: %+v", decoded)
+			}
+		})
+	}
+	decoded := new(client.Reading)
+	if allocs := testing.AllocsPerRun(100, func() { decoded.DecodeFrame(frame) }); allocs != 0 {
+		t.Fatalf("expected DecodeFrame not to allocate actual = %v allocs", allocs)
+	}
+}
+
+//go test -bench=Decode -benchmem ./internal/client
+//BenchmarkDecode         12132039                97.09 ns/op            0 B/op          0 allocs/op
+//BenchmarkDecodeFrame     7281915               169.0 ns/op             0 B/op          0 allocs/op
+func BenchmarkDecodeFrame(b *testing.B) {
+	frame := (&client.Reading{Temperature: 102.45, Latitude: 40.93, Longitude: -165.0, BatteryLevel: .12}).EncodeFrame(1, time.Now())
+	b.ReportAllocs()
+	r := new(client.Reading)
+	for i := 0; i < b.N; i++ {
+		r.DecodeFrame(frame)
+	}
+}
+
+//go test -bench=AppendCSV -benchmem ./internal/client
+//BenchmarkAppendCSV       3725276               284.4 ns/op             0 B/op          0 allocs/op
+func BenchmarkAppendCSV(b *testing.B) {
+	r := &client.Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.25666, Timestamp: time.Now()}
+	dst := make([]byte, 0, 128)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = r.AppendCSV(dst[:0], 490154203237518)
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//State is the lifecycle state of a client connection. A connection only moves forward through the states, except
+//between StateActive & StateIdleWarning
+type State int32
+
+const (
+	//StateAccepted is a connection that hasn't sent any bytes yet
+	StateAccepted State = iota
+	//StateAuthenticating is a connection that has started sending its login message
+	StateAuthenticating
+	//StateActive is a logged in connection that is sending readings
+	StateActive
+	//StateIdleWarning is a logged in connection that hasn't sent a reading for half of its read timeout
+	StateIdleWarning
+	//StateClosing is a connection that is being closed
+	StateClosing
+	//StateClosed is a connection that has been closed
+	StateClosed
+)
+
+var stateNames = [...]string{
+	StateAccepted:       "accepted",
+	StateAuthenticating: "authenticating",
+	StateActive:         "active",
+	StateIdleWarning:    "idle_warning",
+	StateClosing:        "closing",
+	StateClosed:         "closed",
+}
+
+//String returns the name of the state, ex: idle_warning
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+//StateObserver is notified of every connection state transition. The first call for a connection reports its initial
+//state with from equal to to
+type StateObserver interface {
+	StateChanged(c ClientConn, from, to State)
+}
+
+//State returns the current state of the connection
+func (c *client) State() State {
+	return State(atomic.LoadInt32(&c.state))
+}
+
+//StateEntered returns when the connection last entered the given state, or the zero time if it never has
+func (c *client) StateEntered(s State) time.Time {
+	if s < 0 || int(s) >= len(c.entered) {
+		return time.Time{}
+	}
+	if nanos := atomic.LoadInt64(&c.entered[s]); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+//setState moves the connection to the given state, logs the transition & notifies the manager. Transitions out of
+//StateClosing(other than to StateClosed) or StateClosed are ignored. setState doesn't allocate if the connection is
+//already in the state
+func (c *client) setState(to State) {
+	for {
+		from := c.State()
+		if from == to || from == StateClosed || (from == StateClosing && to != StateClosed) {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&c.state, int32(from), int32(to)) {
+			atomic.StoreInt64(&c.entered[to], time.Now().UnixNano())
+			c.manager.GetServerLogger().Printf("[INFO] %v %s state: %s -> %s", c.GetIMEI(), c.conn.RemoteAddr(), from, to)
+			c.manager.StateChanged(c, from, to)
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/common"
+	"math"
+	"strconv"
+)
+
+//Bound is the valid range of a reading field. Min & Max are inclusive unless they're marked exclusive. NaN & ±Inf are
+//never within a bound.
+type Bound struct {
+	Min          float64 `json:"min"`
+	Max          float64 `json:"max"`
+	MinExclusive bool    `json:"minExclusive,omitempty"`
+	MaxExclusive bool    `json:"maxExclusive,omitempty"`
+}
+
+//Contains reports whether v is within the bound. It does NOT allocate
+func (b Bound) Contains(v float64) bool {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return false
+	}
+	switch {
+	case v < b.Min || (b.MinExclusive && v == b.Min):
+		return false
+	case v > b.Max || (b.MaxExclusive && v == b.Max):
+		return false
+	}
+	return true
+}
+
+//String returns the bound in interval notation, ex: (0, 100]
+func (b Bound) String() string {
+	open, close := "[", "]"
+	if b.MinExclusive {
+		open = "("
+	}
+	if b.MaxExclusive {
+		close = ")"
+	}
+	return open + strconv.FormatFloat(b.Min, 'f', -1, 64) + ", " + strconv.FormatFloat(b.Max, 'f', -1, 64) + close
+}
+
+//check returns an error if the bound can't contain any value
+func (b Bound) check() error {
+	switch {
+	case math.IsNaN(b.Min) || math.IsNaN(b.Max) || math.IsInf(b.Min, 0) || math.IsInf(b.Max, 0):
+		return fmt.Errorf("%s must be finite", b)
+	case b.Min > b.Max || (b.Min == b.Max && (b.MinExclusive || b.MaxExclusive)):
+		return fmt.Errorf("%s is empty", b)
+	}
+	return nil
+}
+
+//Validator validates readings against the bounds of each field. Bounds is indexed by Field
+type Validator struct {
+	//Name identifies the validation profile in errors
+	Name   string
+	Bounds [numFields]Bound
+}
+
+//defaultValidator holds the ranges of the protocol specification
+var defaultValidator = Validator{
+	Name: "default",
+	Bounds: [numFields]Bound{
+		FieldTemperature:  {Min: -300, Max: 300},
+		FieldAltitude:     {Min: -20000, Max: 20000},
+		FieldLatitude:     {Min: -90, Max: 90},
+		FieldLongitude:    {Min: -180, Max: 180},
+		FieldBatteryLevel: {Min: 0, Max: 100, MinExclusive: true},
+	},
+}
+
+//DefaultValidator returns a copy of the validator of the protocol specification's ranges, which Decode validates
+//readings with
+func DefaultValidator() Validator {
+	return defaultValidator
+}
+
+//Check returns an error if any of the validator's bounds can't contain any value
+func (v *Validator) Check() error {
+	for field, bound := range v.Bounds {
+		if err := bound.check(); err != nil {
+			return fmt.Errorf("%s: %s", Field(field), err)
+		}
+	}
+	return nil
+}
+
+//fieldErrors are the sentinel errors of each field that is out of range
+var fieldErrors = [numFields]common.ErrType{
+	FieldTemperature:  common.ErrReadingTemp,
+	FieldAltitude:     common.ErrReadingAlt,
+	FieldLatitude:     common.ErrReadingLat,
+	FieldLongitude:    common.ErrReadingLon,
+	FieldBatteryLevel: common.ErrReadingBattery,
+}
+
+//value returns the value of the reading's field
+func (r *Reading) value(field Field) float64 {
+	switch field {
+	case FieldTemperature:
+		return r.Temperature
+	case FieldAltitude:
+		return r.Altitude
+	case FieldLatitude:
+		return r.Latitude
+	case FieldLongitude:
+		return r.Longitude
+	default:
+		return r.BatteryLevel
+	}
+}
+
+//InvalidField returns the first field of the reading that is outside its bound(see validationOrder). It does NOT
+//allocate
+func (v *Validator) InvalidField(r *Reading) (Field, bool) {
+	for _, field := range validationOrder {
+		if !v.Bounds[field].Contains(r.value(field)) {
+			return field, true
+		}
+	}
+	return 0, false
+}
+
+//validationOrder is the order fields are validated in
+var validationOrder = [numFields]Field{FieldTemperature, FieldBatteryLevel, FieldAltitude, FieldLatitude, FieldLongitude}
+
+//Validate returns true with no error if the reading is valid, otherwise it returns a *ValidationError listing every
+//field that is out of range. It does NOT allocate unless the reading is invalid
+func (v *Validator) Validate(r *Reading) (bool, error) {
+	if err := v.validate(r); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//validate returns the reading's validation error, or nil if it is valid. It does NOT allocate unless the reading is
+//invalid
+func (v *Validator) validate(r *Reading) *ValidationError {
+	field, invalid := v.InvalidField(r)
+	if !invalid {
+		return nil
+	}
+	err := &ValidationError{Profile: v.Name}
+	n := 0
+	for _, f := range validationOrder {
+		if f == field || (n > 0 && !v.Bounds[f].Contains(r.value(f))) {
+			err.fields[n] = FieldError{Field: f, Value: r.value(f), Bound: v.Bounds[f]}
+			n++
+		}
+	}
+	err.Fields = err.fields[:n]
+	return err
+}
+
+//FieldError is a reading field that is out of range
+type FieldError struct {
+	Field Field
+	Value float64
+	Bound Bound
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s %v not in %s", e.Field, e.Value, e.Bound)
+}
+
+//ValidationError is returned for a reading that failed validation. It matches common.ErrInvalidReading & the
+//ErrReading* error of each field that is out of range with errors.Is, ex:
+//
+//	if errors.Is(err, common.ErrReadingBattery) {
+//		//the battery level is out of range, other fields may be as well
+//	}
+type ValidationError struct {
+	//Profile is the name of the validator's profile
+	Profile string
+	//Fields are the fields that are out of range, in the order they're validated in
+	Fields []FieldError
+	//fields backs Fields, so the error is a single allocation
+	fields [numFields]FieldError
+}
+
+func (e *ValidationError) Error() string {
+	b := make([]byte, 0, 64*len(e.Fields))
+	b = append(b, common.ErrInvalidReading...)
+	b = append(b, " - "...)
+	for i, f := range e.Fields {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = append(b, f.Error()...)
+	}
+	return string(append(append(append(b, " ("...), e.Profile...), " profile)"...))
+}
+
+//Is reports whether target is common.ErrInvalidReading or the error of a field that is out of range
+func (e *ValidationError) Is(target error) bool {
+	if target == common.ErrInvalidReading {
+		return true
+	}
+	for _, f := range e.Fields {
+		if target == fieldErrors[f.Field] {
+			return true
+		}
+	}
+	return false
+}
+
+//Has reports whether the field is out of range
+func (e *ValidationError) Has(field Field) bool {
+	for _, f := range e.Fields {
+		if f.Field == field {
+			return true
+		}
+	}
+	return false
+}
@@ -4,10 +4,16 @@ package common
 
 import (
 	"fmt"
+	"time"
 )
 
+//ErrType is a sentinel error. Errors wrapping one with Wrap match it with errors.Is
 type ErrType string
 
+func (e ErrType) Error() string {
+	return string(e)
+}
+
 const (
 	// ErrNotImplemented is raised throughout the codebase of the challenge to
 	// denote implementations to be done by the candidate.
@@ -15,6 +21,9 @@ const (
 	ErrInvalidImei    ErrType = "imei: imei: invalid"
 	ErrChecksum       ErrType = "imei: invalid checksum"
 	ErrReadingBytes   ErrType = "reading isn't at least 40 bytes long."
+	//ErrInvalidReading is matched by every reading that failed validation, the ErrReading* errors of the fields that
+	//were out of range are matched as well
+	ErrInvalidReading ErrType = "invalid reading"
 	ErrReadingTemp    ErrType = "the temperature reading of the device is invalid. Celcius. Min/Max: [-300, 300]"
 	ErrReadingAlt     ErrType = "the altitude reading of the device is invalid. Meters. Min/Max: [-20000, 20000]"
 	ErrReadingLat     ErrType = "the latitude reading of the device is invalid. Degrees. Min/Max: [-90, 90]"
@@ -28,13 +37,125 @@ const (
 	MinReadingLength = 40
 )
 
+//Wrap adds details to the error typ
 func Wrap(typ ErrType, details string) error {
-	return fmt.Errorf("%s  - %s", typ, details)
+	return fmt.Errorf("%w  - %s", typ, details)
 }
 
+//Stats holds runtime statistics about the server. Rejected counts connections refused by the server's resource
+//limits, keyed by reason. DuplicateLogins counts logins of already online devices, keyed by outcome. States counts
+//open device connections by lifecycle state, ex: how many haven't logged in. Disconnects counts closed device
+//connections by reason, ex: peer_eof. Fleet aggregates the traffic & quality metrics of every device. Listeners holds the statistics of each
+//device listener, keyed by name. Quarantined is the number of devices that may not log in until their cooldown expires.
+//Output holds the statistics of the reading output queue.
 type Stats struct {
-	GoRoutines        int    `json:"goroutines"`
-	ClientConnections int    `json:"clientConnections"`
-	CPUs              int    `json:"cpus"`
-	Version           string `json:"version"`
+	GoRoutines        int                      `json:"goroutines"`
+	ClientConnections int                      `json:"clientConnections"`
+	Connections       int                      `json:"connections"`
+	PendingLogins     int                      `json:"pendingLogins"`
+	Rejected          map[string]uint64        `json:"rejected"`
+	DuplicateLogins   map[string]uint64        `json:"duplicateLogins"`
+	States            map[string]int64         `json:"states"`
+	Disconnects       map[string]uint64        `json:"disconnects"`
+	Fleet             FleetMetrics             `json:"fleet"`
+	Quarantined       int                      `json:"quarantined"`
+	Output            OutputStats              `json:"output"`
+	Listeners         map[string]ListenerStats `json:"listeners"`
+	CPUs              int                      `json:"cpus"`
+	Version           string                   `json:"version"`
+}
+
+//ListenerStats holds statistics about a single device listener. Rejected counts connections accepted by the listener
+//but refused by either its own or the server's resource limits, keyed by reason. Serving is unset once the listener
+//stopped accepting connections after an accept failure it couldn't recover from, which Error holds.
+type ListenerStats struct {
+	Network       string            `json:"network"`
+	Address       string            `json:"address"`
+	Serving       bool              `json:"serving"`
+	Error         string            `json:"error,omitempty"`
+	Connections   int               `json:"connections"`
+	PendingLogins int               `json:"pendingLogins"`
+	Rejected      map[string]uint64 `json:"rejected"`
+}
+
+//Health is the server's health. Status is ok, or failing while any device listener has stopped accepting connections.
+//FailedListeners holds the accept error of each such listener, keyed by name.
+type Health struct {
+	Status          string            `json:"status"`
+	FailedListeners map[string]string `json:"failedListeners,omitempty"`
+}
+
+//OutputStats holds statistics about the queue reading records wait in before they're written to the reading output.
+//Dropped counts records dropped by the overflow policy while the queue was full.
+type OutputStats struct {
+	QueueDepth    int    `json:"queueDepth"`
+	QueueCapacity int    `json:"queueCapacity"`
+	Overflow      string `json:"overflow"`
+	Pushed        uint64 `json:"pushed"`
+	Dropped       uint64 `json:"dropped"`
+	Written       uint64 `json:"written"`
+	WriteErrors   uint64 `json:"writeErrors"`
+}
+
+//FleetMetrics aggregates the traffic & quality metrics of every device connection. The totals include connections
+//that have since closed, the means only cover logged in connections. InvalidReadings counts readings that failed
+//validation, keyed by the first field that was out of range, and RejectedFields counts every field that was out of
+//range, ex: a failing battery sensor shows up under batteryLevel even if the temperature was out of range too.
+//SequenceGaps, DuplicateFrames & CorruptFrames count the missed, duplicated & corrupt frames of v2 devices.
+type FleetMetrics struct {
+	BytesRead             uint64            `json:"bytesRead"`
+	ValidReadings         uint64            `json:"validReadings"`
+	InvalidReadings       map[string]uint64 `json:"invalidReadings"`
+	RejectedFields        map[string]uint64 `json:"rejectedFields"`
+	SequenceGaps          uint64            `json:"sequenceGaps"`
+	DuplicateFrames       uint64            `json:"duplicateFrames"`
+	CorruptFrames         uint64            `json:"corruptFrames"`
+	MeanLoginLatencyMs    float64           `json:"meanLoginLatencyMs"`
+	MeanMessageIntervalMs float64           `json:"meanMessageIntervalMs"`
+}
+
+//QuarantineEntry is a device that may not log in until its cooldown expires
+type QuarantineEntry struct {
+	IMEI   uint64    `json:"imei"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+//DeviceRecord is what's known of a device that has logged in. ConnectedAt is when its current session started: a device
+//that reconnects within the server's session grace window continues its session & counters, and Reconnects counts
+//the times it did. DisconnectedAt & DisconnectReason are set while the device is offline. Protocol is the protocol
+//version of the device's latest session. SequenceGaps, DuplicateFrames, CorruptFrames & ClockSkewMs(the device's clock
+//minus the server's) & BackfilledReadings are only reported by v2 devices.
+type DeviceRecord struct {
+	IMEI               uint64    `json:"imei"`
+	Online             bool      `json:"online"`
+	RemoteAddr         string    `json:"remoteAddr"`
+	ConnectedAt        time.Time `json:"connectedAt"`
+	LastSeen           time.Time `json:"lastSeen"`
+	DisconnectedAt     time.Time `json:"disconnectedAt"`
+	DisconnectReason   string    `json:"disconnectReason,omitempty"`
+	Reconnects         uint64    `json:"reconnects"`
+	BytesRead          uint64    `json:"bytesRead"`
+	ValidReadings      uint64    `json:"validReadings"`
+	InvalidReadings    uint64    `json:"invalidReadings"`
+	Protocol           int       `json:"protocol"`
+	SequenceGaps       uint64    `json:"sequenceGaps"`
+	DuplicateFrames    uint64    `json:"duplicateFrames"`
+	CorruptFrames      uint64    `json:"corruptFrames"`
+	BackfilledReadings uint64    `json:"backfilledReadings"`
+	ClockSkewMs        float64   `json:"clockSkewMs"`
+}
+
+//CommandStatus is the delivery status of a command sent to a device. Status is one of queued, sent, acknowledged,
+//rejected(the device acknowledged it with an error) or failed(the command couldn't be written to the device)
+type CommandStatus struct {
+	ID      uint32    `json:"id"`
+	IMEI    uint64    `json:"imei"`
+	Type    string    `json:"type"`
+	Arg     uint32    `json:"arg"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
 }
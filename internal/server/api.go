@@ -1,7 +1,28 @@
 package server
 
-import "context"
+import (
+	"context"
+	"net"
+)
 
+//Server serves device connections over tcp and the http api
 type Server interface {
+	//Listen starts the server and blocks until ctx is cancelled, after which the server is stopped
 	Listen(ctx context.Context)
+	//Start binds the server's listeners and serves them in the background. It returns once the server is ready
+	Start(ctx context.Context) error
+	//Stop stops the server, closing every device connection. It returns once every connection is closed
+	Stop(ctx context.Context) error
+	//Addr returns the addresses the server is bound to
+	Addr() Addr
+}
+
+//Addr holds the addresses a server is bound to
+type Addr struct {
+	//Device is the address of the default TcpAddr:TcpPort device listener
+	Device net.Addr
+	//Devices are the addresses of every device listener, starting with the default listener
+	Devices []net.Addr
+	//HTTP is the address the http api is served on
+	HTTP net.Addr
 }
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/client"
+	"github.com/autom8ter/thermomatic/internal/common"
+	"sync"
+	"time"
+)
+
+const (
+	commandQueued       = "queued"
+	commandSent         = "sent"
+	commandAcknowledged = "acknowledged"
+	commandRejected     = "rejected"
+	commandFailed       = "failed"
+)
+
+const (
+	//maxQueuedCommands is the number of undelivered commands a device may have
+	maxQueuedCommands = 16
+	//maxCommandHistory is the number of commands whose status is kept per device
+	maxCommandHistory = 64
+	//maxCommandDevices is the number of devices whose commands are kept. Once it's reached the commands of a device
+	//with no undelivered commands are forgotten to make room for another device
+	maxCommandDevices = 10000
+)
+
+var (
+	errCommandQueueFull   = errors.New("command queue full")
+	errCommandDevicesFull = errors.New("too many devices with undelivered commands")
+)
+
+//commands queues commands for devices until they're online & tracks each command's delivery status
+type commands struct {
+	mu      sync.Mutex
+	next    uint32
+	devices map[uint64]*deviceCommands
+}
+
+//deviceCommands holds a device's undelivered commands & its most recent commands
+type deviceCommands struct {
+	queue   []*command
+	history []*command
+	//sending serializes deliveries so commands are written in the order they were queued
+	sending sync.Mutex
+}
+
+//command is a command & its delivery status
+type command struct {
+	cmd    client.Command
+	status common.CommandStatus
+}
+
+func newCommands() *commands {
+	return &commands{devices: map[uint64]*deviceCommands{}}
+}
+
+//device returns the device's commands, adding the device if there's room for it
+func (q *commands) device(imei uint64) (*deviceCommands, error) {
+	if d, ok := q.devices[imei]; ok {
+		return d, nil
+	}
+	if len(q.devices) >= maxCommandDevices && !q.evict() {
+		return nil, errCommandDevicesFull
+	}
+	d := &deviceCommands{}
+	q.devices[imei] = d
+	return d, nil
+}
+
+//evict forgets the commands of a device with no undelivered or unacknowledged commands. It reports whether a device
+//was evicted
+func (q *commands) evict() bool {
+	for imei, d := range q.devices {
+		if d.settled() {
+			delete(q.devices, imei)
+			return true
+		}
+	}
+	return false
+}
+
+//settled reports whether every one of the device's commands has been acknowledged, rejected or failed
+func (d *deviceCommands) settled() bool {
+	if len(d.queue) > 0 {
+		return false
+	}
+	for _, c := range d.history {
+		if c.status.Status == commandSent {
+			return false
+		}
+	}
+	return true
+}
+
+//enqueue queues a command for the device
+func (q *commands) enqueue(imei uint64, typ client.CommandType, arg uint32) (common.CommandStatus, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	d, err := q.device(imei)
+	if err != nil {
+		return common.CommandStatus{}, err
+	}
+	if len(d.queue) >= maxQueuedCommands {
+		return common.CommandStatus{}, errCommandQueueFull
+	}
+	q.next++
+	now := time.Now()
+	c := &command{
+		cmd: client.Command{ID: q.next, Type: typ, Arg: arg},
+		status: common.CommandStatus{
+			ID:      q.next,
+			IMEI:    imei,
+			Type:    typ.String(),
+			Arg:     arg,
+			Status:  commandQueued,
+			Created: now,
+			Updated: now,
+		},
+	}
+	d.queue = append(d.queue, c)
+	d.history = append(d.history, c)
+	if len(d.history) > maxCommandHistory {
+		d.history = append(d.history[:0], d.history[len(d.history)-maxCommandHistory:]...)
+	}
+	return c.status, nil
+}
+
+//deliver sends the device's queued commands to its most recent session. Commands stay queued while the device is
+//offline
+func (s *server) deliver(imei uint64) {
+	q := s.commands
+	q.mu.Lock()
+	d, ok := q.devices[imei]
+	q.mu.Unlock()
+	if !ok {
+		return
+	}
+	d.sending.Lock()
+	defer d.sending.Unlock()
+	for {
+		session, ok := s.devices.latest(imei)
+		if !ok {
+			return
+		}
+		q.mu.Lock()
+		if len(d.queue) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		c := d.queue[0]
+		d.queue = d.queue[1:]
+		cmd := c.cmd
+		//the command is marked sent before it's written since the device may acknowledge it before Send returns
+		c.status.Status, c.status.Updated = commandSent, time.Now()
+		q.mu.Unlock()
+		err := session.Send(cmd)
+		if err != nil {
+			q.mu.Lock()
+			c.status.Status, c.status.Error, c.status.Updated = commandFailed, err.Error(), time.Now()
+			q.mu.Unlock()
+			s.serverLog.Printf("[ERROR] %v failed to send command %v: %s", imei, cmd.ID, err)
+			continue
+		}
+		s.serverLog.Printf("[INFO] %v sent command %v: %s", imei, cmd.ID, cmd.Type)
+	}
+}
+
+//deliveries tracks the goroutines delivering commands. No delivery starts once the server is stopping, so stop may
+//wait for them without racing a delivery being started
+type deliveries struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	stopping bool
+}
+
+//start runs deliver in a new goroutine unless the server is stopping. It reports whether the delivery was started
+func (d *deliveries) start(deliver func()) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopping {
+		return false
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		deliver()
+	}()
+	return true
+}
+
+//stop prevents new deliveries & waits for the started ones to finish
+func (d *deliveries) stop() {
+	d.mu.Lock()
+	d.stopping = true
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+//acknowledge updates the status of a sent command from the device's acknowledgement
+func (q *commands) acknowledge(imei uint64, ack client.Ack) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if d, ok := q.devices[imei]; ok {
+		for _, c := range d.history {
+			status := &c.status
+			if status.ID != ack.ID {
+				continue
+			}
+			if status.Status != commandSent {
+				return fmt.Errorf("command %v is %s", ack.ID, status.Status)
+			}
+			status.Updated = time.Now()
+			if ack.Status == client.AckOK {
+				status.Status = commandAcknowledged
+			} else {
+				status.Status, status.Error = commandRejected, fmt.Sprintf("device responded: %s", ack.Status)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown command %v", ack.ID)
+}
+
+//get returns the status of one of the device's commands
+func (q *commands) get(imei uint64, id uint32) (common.CommandStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if d, ok := q.devices[imei]; ok {
+		for _, c := range d.history {
+			if c.status.ID == id {
+				return c.status, true
+			}
+		}
+	}
+	return common.CommandStatus{}, false
+}
+
+//list returns the status of the device's most recent commands, oldest first
+func (q *commands) list(imei uint64) []common.CommandStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	d, ok := q.devices[imei]
+	if !ok {
+		return []common.CommandStatus{}
+	}
+	statuses := make([]common.CommandStatus, 0, len(d.history))
+	for _, c := range d.history {
+		statuses = append(statuses, c.status)
+	}
+	return statuses
+}
+
+//CommandAcked updates the delivery status of the acknowledged command
+func (s *server) CommandAcked(c client.ClientConn, ack client.Ack) {
+	if err := s.commands.acknowledge(c.GetIMEI(), ack); err != nil {
+		s.serverLog.Printf("[WARN] %v unexpected acknowledgement: %s", c.GetIMEI(), err)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"github.com/autom8ter/thermomatic/internal/client"
+	"testing"
+	"time"
+)
+
+//TestCommandsMaxDevices fails if the commands of more than maxCommandDevices devices are kept, or if a device with
+//undelivered commands is forgotten to make room for another
+func TestCommandsMaxDevices(t *testing.T) {
+	q := newCommands()
+	for imei := uint64(1); imei <= maxCommandDevices; imei++ {
+		if _, err := q.enqueue(imei, client.CommandReboot, 0); err != nil {
+			t.Fatalf("unexpected error queueing command %v: %s", imei, err)
+		}
+	}
+	if _, err := q.enqueue(maxCommandDevices+1, client.CommandReboot, 0); err != errCommandDevicesFull {
+		t.Fatalf("expected %v actual = %v", errCommandDevicesFull, err)
+	}
+	//a device whose commands have all been answered makes room for another device
+	d := q.devices[42]
+	d.queue[0].status.Status = commandFailed
+	d.queue = d.queue[:0]
+	if _, err := q.enqueue(maxCommandDevices+1, client.CommandReboot, 0); err != nil {
+		t.Fatalf("expected an evicted device to make room actual = %v", err)
+	}
+	if _, ok := q.devices[42]; ok || len(q.devices) != maxCommandDevices {
+		t.Fatalf("expected device 42 to be evicted, %v devices", len(q.devices))
+	}
+	//a device with an unacknowledged command isn't evicted
+	d = q.devices[7]
+	d.queue[0].status.Status = commandSent
+	d.queue = d.queue[:0]
+	if _, err := q.enqueue(maxCommandDevices+2, client.CommandReboot, 0); err != errCommandDevicesFull {
+		t.Fatalf("expected %v actual = %v", errCommandDevicesFull, err)
+	}
+}
+
+//TestDeliveriesStop fails if stop doesn't wait for a started delivery, or a delivery starts once the server is stopping
+func TestDeliveriesStop(t *testing.T) {
+	var (
+		d        = &deliveries{}
+		release  = make(chan struct{})
+		finished = make(chan struct{})
+	)
+	if !d.start(func() {
+		<-release
+		close(finished)
+	}) {
+		t.Fatal("expected the delivery to start")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		d.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("expected stop to wait for the delivery")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+	select {
+	case <-finished:
+	default:
+		t.Fatal("expected the delivery to finish before stop returned")
+	}
+	if d.start(func() { t.Error("unexpected delivery after stop") }) {
+		t.Fatal("expected no delivery to start after stop")
+	}
+}
@@ -0,0 +1,535 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/client"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+//policies for a device logging in while another connection with the same imei is online
+const (
+	//DuplicateLoginReject closes the new connection
+	DuplicateLoginReject = "reject"
+	//DuplicateLoginEvict closes the existing connection(s)
+	DuplicateLoginEvict = "evict"
+	//DuplicateLoginAllow keeps both connections online as separate sessions
+	DuplicateLoginAllow = "allow"
+)
+
+//modes of servicing device connections
+const (
+	//IngestGoroutine serves each device connection from its own goroutine
+	IngestGoroutine = "goroutine"
+	//IngestEpoll serves every device connection from a small pool of epoll workers(linux only)
+	IngestEpoll = "epoll"
+)
+
+//EnvPrefix prefixes every environment variable that overrides a config setting, ex: THERMOMATIC_TCP_PORT
+const EnvPrefix = "THERMOMATIC_"
+
+//Duration is a time.Duration that is written as a human readable string (ex: "2s") in config files, env vars & flags
+type Duration time.Duration
+
+//String returns the duration formatted like time.Duration
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+//Set parses a duration string(ex: "1m30s"). It implements flag.Value
+func (d *Duration) Set(value string) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+//MarshalJSON encodes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+//UnmarshalJSON decodes a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return fmt.Errorf("duration must be a string(ex: \"2s\"): %s", string(b))
+	}
+	return d.Set(value)
+}
+
+//networks a device listener may bind
+const (
+	networkTCP  = "tcp"
+	networkTCP4 = "tcp4"
+	networkTCP6 = "tcp6"
+	networkUnix = "unix"
+)
+
+//ListenerConfig configures an additional device listener. Zero timeouts inherit the server's timeouts & zero limits
+//are unlimited. The server's own limits still apply across every listener.
+type ListenerConfig struct {
+	//Name identifies the listener in /stats. Defaults to network:address
+	Name string `json:"name,omitempty"`
+	//Network is tcp, tcp4, tcp6 or unix
+	Network string `json:"network"`
+	//Address is host:port for tcp networks or the socket file path for unix
+	Address string `json:"address"`
+	//LoginTimeout is how long a device has to send its login message after connecting
+	LoginTimeout Duration `json:"loginTimeout,omitempty"`
+	//ReadTimeout is how long a device may go without sending a reading before it is dropped
+	ReadTimeout Duration `json:"readTimeout,omitempty"`
+	//MaxConnections caps the number of simultaneous device connections on the listener
+	MaxConnections int `json:"maxConnections,omitempty"`
+	//MaxConnectionsPerIP caps the number of simultaneous device connections from a single source ip on the listener.
+	//Every unix socket connection shares the same source
+	MaxConnectionsPerIP int `json:"maxConnectionsPerIP,omitempty"`
+	//MaxPendingLogins caps the number of connections on the listener that haven't sent their login message yet
+	MaxPendingLogins int `json:"maxPendingLogins,omitempty"`
+	//AcceptRate is the number of new device connections accepted per second on the listener
+	AcceptRate float64 `json:"acceptRate,omitempty"`
+	//AcceptBurst is the number of connections that may be accepted at once above AcceptRate. Zero means 1
+	AcceptBurst int `json:"acceptBurst,omitempty"`
+}
+
+//name returns the name the listener is reported under
+func (l *ListenerConfig) name() string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return l.Network + ":" + l.Address
+}
+
+//ValidationProfile sets the reading bounds of a group of devices, selected by imei or by the prefix of their imei,
+//ex: a TAC(the first 8 digits, which identify the device model). Bounds left out keep the default profile's bounds.
+//A profile named default replaces the bounds of devices no other profile selects.
+type ValidationProfile struct {
+	Name string `json:"name"`
+	//IMEIs select individual devices
+	IMEIs []uint64 `json:"imeis,omitempty"`
+	//TACPrefixes select devices whose imei starts with any of the prefixes. The longest matching prefix wins
+	TACPrefixes  []string      `json:"tacPrefixes,omitempty"`
+	Temperature  *client.Bound `json:"temperature,omitempty"`
+	Altitude     *client.Bound `json:"altitude,omitempty"`
+	Latitude     *client.Bound `json:"latitude,omitempty"`
+	Longitude    *client.Bound `json:"longitude,omitempty"`
+	BatteryLevel *client.Bound `json:"batteryLevel,omitempty"`
+}
+
+//listenersFlag is a flag.Value of comma separated network:address listeners, ex: unix:/run/thermomatic.sock,tcp::1339
+type listenersFlag struct {
+	listeners *[]ListenerConfig
+}
+
+func (f listenersFlag) String() string {
+	if f.listeners == nil {
+		return ""
+	}
+	var specs []string
+	for _, l := range *f.listeners {
+		specs = append(specs, l.Network+":"+l.Address)
+	}
+	return strings.Join(specs, ",")
+}
+
+//Set replaces the listeners with the given ones
+func (f listenersFlag) Set(value string) error {
+	var listeners []ListenerConfig
+	for _, spec := range strings.Split(value, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("listener must be network:address, got %q", spec)
+		}
+		listeners = append(listeners, ListenerConfig{Network: parts[0], Address: parts[1]})
+	}
+	*f.listeners = listeners
+	return nil
+}
+
+//Config holds the configuration requirements to start the server
+type Config struct {
+	//TcpAddr is the interface the device listener binds to. Empty binds all interfaces
+	TcpAddr string `json:"tcpAddr"`
+	//TcpPort is the port devices connect to
+	TcpPort int `json:"tcpPort"`
+	//HttpAddr is the interface the http server binds to. Empty binds all interfaces
+	HttpAddr string `json:"httpAddr"`
+	//HttpPort is the port the http api is served on
+	HttpPort int `json:"httpPort"`
+	//ClientLogPrefix prefixes every reading record. Empty by default, so records are plain csv
+	ClientLogPrefix string `json:"clientLogPrefix"`
+	//ServerLogPrefix prefixes every server log line
+	ServerLogPrefix string `json:"serverLogPrefix"`
+	//ReadingOutput is where reading records are written: stdout, stderr or a file path
+	ReadingOutput string `json:"readingOutput"`
+	//ReadingFlushInterval is how often buffered reading records are written to the ReadingOutput. Zero writes records
+	//as soon as the output queue is drained
+	ReadingFlushInterval Duration `json:"readingFlushInterval"`
+	//OutputQueueSize is the number of reading records queued for the ReadingOutput, rounded up to a power of 2
+	OutputQueueSize int `json:"outputQueueSize"`
+	//OutputOverflow decides what happens to a reading record while the output queue is full: block(the connection
+	//waits), drop-newest or drop-oldest
+	OutputOverflow string `json:"outputOverflow"`
+	//LogOutput is where server logs are written: stdout, stderr or a file path
+	LogOutput string `json:"logOutput"`
+	//LoginTimeout is how long a device has to send its login message after connecting
+	LoginTimeout Duration `json:"loginTimeout"`
+	//ReadTimeout is how long a device may go without sending a reading before it is dropped
+	ReadTimeout Duration `json:"readTimeout"`
+	//OnlineWindow is how recent a device's last reading must be for /status to report it online
+	OnlineWindow Duration `json:"onlineWindow"`
+	//ShutdownTimeout is how long the http server is given to finish in-flight requests on shutdown
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	//MaxConnections caps the number of simultaneous device connections. Zero means unlimited
+	MaxConnections int `json:"maxConnections"`
+	//MaxConnectionsPerIP caps the number of simultaneous device connections from a single source ip. Zero means unlimited
+	MaxConnectionsPerIP int `json:"maxConnectionsPerIP"`
+	//MaxPendingLogins caps the number of connections that haven't sent their login message yet. Zero means unlimited
+	MaxPendingLogins int `json:"maxPendingLogins"`
+	//AcceptRate is the number of new device connections accepted per second. Zero means unlimited
+	AcceptRate float64 `json:"acceptRate"`
+	//AcceptBurst is the number of connections that may be accepted at once above AcceptRate
+	AcceptBurst int `json:"acceptBurst"`
+	//DuplicateLoginPolicy decides what happens when a device logs in while already online: reject, evict or allow
+	DuplicateLoginPolicy string `json:"duplicateLoginPolicy"`
+	//IngestMode is how device connections are serviced: goroutine(one goroutine per connection) or epoll(linux only)
+	IngestMode string `json:"ingestMode"`
+	//PollWorkers is the number of epoll workers in epoll ingest mode. Zero means one per cpu
+	PollWorkers int `json:"pollWorkers"`
+	//MaxConsecutiveInvalid disconnects a device after this many consecutive invalid readings. Zero disables the check
+	MaxConsecutiveInvalid int `json:"maxConsecutiveInvalid"`
+	//InvalidWindow is the number of most recent readings MaxInvalidRatio is measured over(at most 64)
+	InvalidWindow int `json:"invalidWindow"`
+	//MaxInvalidRatio disconnects a device once the ratio of invalid readings in its InvalidWindow exceeds it. Zero
+	//disables the check
+	MaxInvalidRatio float64 `json:"maxInvalidRatio"`
+	//QuarantineCooldown is how long a device disconnected for invalid readings may not log in again. Zero disables
+	//quarantine
+	QuarantineCooldown Duration `json:"quarantineCooldown"`
+	//SessionGrace is how long an offline device's cached reading is kept. A device that reconnects within it continues
+	//its session
+	SessionGrace Duration `json:"sessionGrace"`
+	//LastKnownFile is the path last known device records are saved to & loaded from. Empty keeps them in memory only
+	LastKnownFile string `json:"lastKnownFile"`
+	//LastKnownRetention is how long the last known record of an offline device is kept. Zero keeps records forever
+	LastKnownRetention Duration `json:"lastKnownRetention"`
+	//Commands enables the device command channel: commands are queued with POST /devices/{imei}/commands and written to
+	//the device once it's online
+	Commands bool `json:"commands"`
+	//TCPKeepAlive is the interval of keepalive probes sent on idle tcp device connections, so half-open connections of
+	//devices that vanished are detected by the kernel. Zero disables keepalive
+	TCPKeepAlive Duration `json:"tcpKeepAlive"`
+	//TCPUserTimeout is how long data written to a tcp device connection may go unacknowledged before the kernel closes
+	//it(linux only). Zero uses the kernel's default
+	TCPUserTimeout Duration `json:"tcpUserTimeout"`
+	//TCPNoDelay disables Nagle's algorithm on tcp device connections, so commands are written without delay
+	TCPNoDelay bool `json:"tcpNoDelay"`
+	//TCPReadBuffer & TCPWriteBuffer are the socket buffer sizes of tcp device connections in bytes. Zero uses the
+	//kernel's default
+	TCPReadBuffer  int `json:"tcpReadBuffer"`
+	TCPWriteBuffer int `json:"tcpWriteBuffer"`
+	//ValidationProfiles set the reading bounds of groups of devices. Devices no profile selects are validated against
+	//the protocol specification, unless a profile named default is given
+	ValidationProfiles []ValidationProfile `json:"validationProfiles"`
+	//Listeners are additional device listeners served alongside the TcpAddr:TcpPort listener, ex: a unix socket for a
+	//local gateway
+	Listeners []ListenerConfig `json:"listeners"`
+}
+
+//DefaultConfig returns the default server configuration
+func DefaultConfig() *Config {
+	return &Config{
+		TcpPort:              1337,
+		HttpPort:             1338,
+		ServerLogPrefix:      "Thermomatic-Server: ",
+		ReadingOutput:        "stdout",
+		ReadingFlushInterval: Duration(100 * time.Millisecond),
+		OutputQueueSize:      8192,
+		OutputOverflow:       OverflowBlock,
+		LogOutput:            "stderr",
+		LoginTimeout:         Duration(1 * time.Second),
+		ReadTimeout:          Duration(2 * time.Second),
+		OnlineWindow:         Duration(5 * time.Minute),
+		ShutdownTimeout:      Duration(5 * time.Second),
+		SessionGrace:         Duration(30 * time.Second),
+		LastKnownRetention:   Duration(7 * 24 * time.Hour),
+		TCPKeepAlive:         Duration(15 * time.Second),
+		TCPNoDelay:           true,
+		AcceptBurst:          1,
+		DuplicateLoginPolicy: DuplicateLoginEvict,
+		IngestMode:           IngestGoroutine,
+	}
+}
+
+//Validate returns an error describing every invalid setting in the config
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if c.TcpPort < 0 || c.TcpPort > 65535 {
+		invalid("tcpPort must be between 0 and 65535, got %v", c.TcpPort)
+	}
+	if c.HttpPort < 0 || c.HttpPort > 65535 {
+		invalid("httpPort must be between 0 and 65535, got %v", c.HttpPort)
+	}
+	if c.TcpPort != 0 && c.TcpPort == c.HttpPort && c.TcpAddr == c.HttpAddr {
+		invalid("tcpPort and httpPort must not be the same, got %v", c.TcpPort)
+	}
+	if c.ReadingOutput == "" {
+		invalid("readingOutput must be stdout, stderr or a file path")
+	}
+	if c.ReadingFlushInterval < 0 {
+		invalid("readingFlushInterval must not be negative, got %s", c.ReadingFlushInterval)
+	}
+	if c.OutputQueueSize < 1 {
+		invalid("outputQueueSize must be at least 1, got %v", c.OutputQueueSize)
+	}
+	switch c.OutputOverflow {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	default:
+		invalid("outputOverflow must be one of %s, %s or %s, got %q", OverflowBlock, OverflowDropNewest, OverflowDropOldest, c.OutputOverflow)
+	}
+	if c.LogOutput == "" {
+		invalid("logOutput must be stdout, stderr or a file path")
+	}
+	if c.LoginTimeout <= 0 {
+		invalid("loginTimeout must be positive, got %s", c.LoginTimeout)
+	}
+	if c.ReadTimeout <= 0 {
+		invalid("readTimeout must be positive, got %s", c.ReadTimeout)
+	}
+	if c.OnlineWindow <= 0 {
+		invalid("onlineWindow must be positive, got %s", c.OnlineWindow)
+	}
+	if c.ShutdownTimeout <= 0 {
+		invalid("shutdownTimeout must be positive, got %s", c.ShutdownTimeout)
+	}
+	if c.MaxConnections < 0 {
+		invalid("maxConnections must not be negative, got %v", c.MaxConnections)
+	}
+	if c.MaxConnectionsPerIP < 0 {
+		invalid("maxConnectionsPerIP must not be negative, got %v", c.MaxConnectionsPerIP)
+	}
+	if c.MaxPendingLogins < 0 {
+		invalid("maxPendingLogins must not be negative, got %v", c.MaxPendingLogins)
+	}
+	if c.AcceptRate < 0 {
+		invalid("acceptRate must not be negative, got %v", c.AcceptRate)
+	}
+	if c.AcceptRate > 0 && c.AcceptBurst < 1 {
+		invalid("acceptBurst must be at least 1, got %v", c.AcceptBurst)
+	}
+	switch c.DuplicateLoginPolicy {
+	case DuplicateLoginReject, DuplicateLoginEvict, DuplicateLoginAllow:
+	default:
+		invalid("duplicateLoginPolicy must be one of %s, %s or %s, got %q", DuplicateLoginReject, DuplicateLoginEvict, DuplicateLoginAllow, c.DuplicateLoginPolicy)
+	}
+	switch c.IngestMode {
+	case IngestGoroutine, IngestEpoll:
+	default:
+		invalid("ingestMode must be one of %s or %s, got %q", IngestGoroutine, IngestEpoll, c.IngestMode)
+	}
+	if c.PollWorkers < 0 {
+		invalid("pollWorkers must not be negative, got %v", c.PollWorkers)
+	}
+	if c.MaxConsecutiveInvalid < 0 {
+		invalid("maxConsecutiveInvalid must not be negative, got %v", c.MaxConsecutiveInvalid)
+	}
+	if c.InvalidWindow < 0 || c.InvalidWindow > client.MaxInvalidWindow {
+		invalid("invalidWindow must be between 0 and %v, got %v", client.MaxInvalidWindow, c.InvalidWindow)
+	}
+	if c.MaxInvalidRatio < 0 || c.MaxInvalidRatio >= 1 {
+		invalid("maxInvalidRatio must be at least 0 and less than 1, got %v", c.MaxInvalidRatio)
+	}
+	if c.MaxInvalidRatio > 0 && c.InvalidWindow == 0 {
+		invalid("invalidWindow must be set to use maxInvalidRatio")
+	}
+	if c.SessionGrace < 0 {
+		invalid("sessionGrace must not be negative, got %s", c.SessionGrace)
+	}
+	if c.LastKnownRetention != 0 && c.LastKnownRetention < c.SessionGrace {
+		invalid("lastKnownRetention must be at least sessionGrace(%s) or 0, got %s", c.SessionGrace, c.LastKnownRetention)
+	}
+	if c.QuarantineCooldown < 0 {
+		invalid("quarantineCooldown must not be negative, got %s", c.QuarantineCooldown)
+	}
+	if c.TCPKeepAlive < 0 {
+		invalid("tcpKeepAlive must not be negative, got %s", c.TCPKeepAlive)
+	}
+	if c.TCPUserTimeout < 0 {
+		invalid("tcpUserTimeout must not be negative, got %s", c.TCPUserTimeout)
+	}
+	if c.TCPUserTimeout > 0 && !userTimeoutSupported {
+		invalid("tcpUserTimeout is only supported on linux")
+	}
+	if c.TCPReadBuffer < 0 || c.TCPWriteBuffer < 0 {
+		invalid("tcpReadBuffer & tcpWriteBuffer must not be negative, got %v & %v", c.TCPReadBuffer, c.TCPWriteBuffer)
+	}
+	profiles := map[string]bool{}
+	for i, p := range c.ValidationProfiles {
+		switch {
+		case p.Name == "":
+			invalid("validationProfiles[%v].name must not be empty", i)
+		case profiles[p.Name]:
+			invalid("validationProfiles[%v].name must be unique, got %q", i, p.Name)
+		case p.Name == defaultProfile && (len(p.IMEIs) > 0 || len(p.TACPrefixes) > 0):
+			invalid("validationProfiles[%v] named %s must not select devices", i, defaultProfile)
+		case p.Name != defaultProfile && len(p.IMEIs) == 0 && len(p.TACPrefixes) == 0:
+			invalid("validationProfiles[%v] must select devices by imeis or tacPrefixes", i)
+		}
+		profiles[p.Name] = true
+	}
+	if _, err := newValidators(c.ValidationProfiles); err != nil {
+		invalid("%s", err)
+	}
+	names := map[string]bool{defaultListener: true}
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		switch l.Network {
+		case networkTCP, networkTCP4, networkTCP6, networkUnix:
+		default:
+			invalid("listeners[%v].network must be one of tcp, tcp4, tcp6 or unix, got %q", i, l.Network)
+		}
+		if l.Address == "" {
+			invalid("listeners[%v].address must not be empty", i)
+		}
+		if names[l.name()] {
+			invalid("listeners[%v].name must be unique, got %q", i, l.name())
+		}
+		names[l.name()] = true
+		if l.LoginTimeout < 0 || l.ReadTimeout < 0 {
+			invalid("listeners[%v] timeouts must not be negative", i)
+		}
+		if l.MaxConnections < 0 || l.MaxConnectionsPerIP < 0 || l.MaxPendingLogins < 0 || l.AcceptRate < 0 || l.AcceptBurst < 0 {
+			invalid("listeners[%v] limits must not be negative", i)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+//String returns the config as indented json
+func (c *Config) String() string {
+	bits, _ := json.MarshalIndent(c, "", "  ")
+	return string(bits)
+}
+
+//registerFlags binds a flag to every config setting. Each flag may also be set with an env var named after it,
+//ex: -tcp-port => THERMOMATIC_TCP_PORT
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.TcpAddr, "tcp-addr", c.TcpAddr, "interface the device listener binds to")
+	fs.IntVar(&c.TcpPort, "tcp-port", c.TcpPort, "port devices connect to")
+	fs.StringVar(&c.HttpAddr, "http-addr", c.HttpAddr, "interface the http server binds to")
+	fs.IntVar(&c.HttpPort, "http-port", c.HttpPort, "port the http api is served on")
+	fs.StringVar(&c.ClientLogPrefix, "client-log-prefix", c.ClientLogPrefix, "prefix of every reading record")
+	fs.StringVar(&c.ServerLogPrefix, "server-log-prefix", c.ServerLogPrefix, "prefix of every server log line")
+	fs.StringVar(&c.ReadingOutput, "reading-output", c.ReadingOutput, "where reading records are written: stdout, stderr or a file path")
+	fs.Var(&c.ReadingFlushInterval, "reading-flush-interval", "how often buffered reading records are written(0 = whenever the output queue is drained)")
+	fs.IntVar(&c.OutputQueueSize, "output-queue-size", c.OutputQueueSize, "number of reading records queued for the reading output")
+	fs.StringVar(&c.OutputOverflow, "output-overflow", c.OutputOverflow, "what happens to a reading record while the output queue is full: block, drop-newest or drop-oldest")
+	fs.StringVar(&c.LogOutput, "log-output", c.LogOutput, "where server logs are written: stdout, stderr or a file path")
+	fs.Var(&c.LoginTimeout, "login-timeout", "how long a device has to log in after connecting")
+	fs.Var(&c.ReadTimeout, "read-timeout", "how long a device may go without sending a reading")
+	fs.Var(&c.OnlineWindow, "online-window", "how recent a reading must be for /status to report a device online")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout", "how long the http server has to shut down")
+	fs.IntVar(&c.MaxConnections, "max-connections", c.MaxConnections, "maximum simultaneous device connections(0 = unlimited)")
+	fs.IntVar(&c.MaxConnectionsPerIP, "max-connections-per-ip", c.MaxConnectionsPerIP, "maximum simultaneous device connections per source ip(0 = unlimited)")
+	fs.IntVar(&c.MaxPendingLogins, "max-pending-logins", c.MaxPendingLogins, "maximum connections waiting to log in(0 = unlimited)")
+	fs.Float64Var(&c.AcceptRate, "accept-rate", c.AcceptRate, "new device connections accepted per second(0 = unlimited)")
+	fs.IntVar(&c.AcceptBurst, "accept-burst", c.AcceptBurst, "connections accepted at once above the accept rate")
+	fs.StringVar(&c.IngestMode, "ingest-mode", c.IngestMode, "how device connections are serviced: goroutine or epoll(linux only)")
+	fs.IntVar(&c.PollWorkers, "poll-workers", c.PollWorkers, "number of epoll workers in epoll ingest mode(0 = one per cpu)")
+	fs.IntVar(&c.MaxConsecutiveInvalid, "max-consecutive-invalid", c.MaxConsecutiveInvalid, "consecutive invalid readings that disconnect a device(0 = never)")
+	fs.IntVar(&c.InvalidWindow, "invalid-window", c.InvalidWindow, "number of recent readings the invalid ratio is measured over(max 64)")
+	fs.Float64Var(&c.MaxInvalidRatio, "max-invalid-ratio", c.MaxInvalidRatio, "ratio of invalid readings in the invalid window that disconnects a device(0 = never)")
+	fs.Var(&c.QuarantineCooldown, "quarantine-cooldown", "how long a device disconnected for invalid readings may not log in(0 = no quarantine)")
+	fs.Var(&c.SessionGrace, "session-grace", "how long an offline device's reading is kept & its session may be resumed")
+	fs.StringVar(&c.LastKnownFile, "last-known-file", c.LastKnownFile, "file last known device records are saved to(empty = memory only)")
+	fs.Var(&c.LastKnownRetention, "last-known-retention", "how long the last known record of an offline device is kept(0 = forever)")
+	fs.BoolVar(&c.Commands, "commands", c.Commands, "enable the device command channel")
+	fs.Var(&c.TCPKeepAlive, "tcp-keepalive", "interval of keepalive probes on idle tcp device connections(0 = disabled)")
+	fs.Var(&c.TCPUserTimeout, "tcp-user-timeout", "how long written data may go unacknowledged before a tcp device connection is closed(linux only, 0 = kernel default)")
+	fs.BoolVar(&c.TCPNoDelay, "tcp-nodelay", c.TCPNoDelay, "disable Nagle's algorithm on tcp device connections")
+	fs.IntVar(&c.TCPReadBuffer, "tcp-read-buffer", c.TCPReadBuffer, "socket read buffer size of tcp device connections in bytes(0 = kernel default)")
+	fs.IntVar(&c.TCPWriteBuffer, "tcp-write-buffer", c.TCPWriteBuffer, "socket write buffer size of tcp device connections in bytes(0 = kernel default)")
+	fs.Var(listenersFlag{listeners: &c.Listeners}, "listeners", "additional comma separated network:address device listeners, ex: unix:/run/thermomatic.sock,tcp::1339")
+	fs.StringVar(&c.DuplicateLoginPolicy, "duplicate-login-policy", c.DuplicateLoginPolicy, "what happens when an online device logs in again: reject, evict or allow")
+}
+
+//envName returns the env var that overrides the given flag
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+//LoadConfigFile decodes the json config file at path into c. Settings missing from the file are left untouched
+func LoadConfigFile(path string, c *Config) error {
+	bits, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %s", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(bits))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("config file %s: %s", path, err)
+	}
+	return nil
+}
+
+//LoadConfig builds the server config from command-line args & env vars(see os.LookupEnv). Settings are resolved in
+//order of precedence: flags, THERMOMATIC_* env vars, the json file given by -config(or THERMOMATIC_CONFIG), then
+//DefaultConfig. printConfig reports whether -print-config was set. The returned config is validated.
+func LoadConfig(args []string, lookupEnv func(key string) (string, bool)) (config *Config, printConfig bool, err error) {
+	var (
+		flags      = flag.NewFlagSet("thermomatic", flag.ContinueOnError)
+		configPath = flags.String("config", "", "path to a json config file")
+	)
+	flags.BoolVar(&printConfig, "print-config", false, "print the resolved config as json and exit")
+	DefaultConfig().registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if *configPath == "" {
+		*configPath, _ = lookupEnv(envName("config"))
+	}
+	config = DefaultConfig()
+	if *configPath != "" {
+		if err := LoadConfigFile(*configPath, config); err != nil {
+			return nil, false, err
+		}
+	}
+	//bind a second flag set to the resolved config so env vars & explicitly set flags are applied on top of the file
+	resolved := flag.NewFlagSet("thermomatic", flag.ContinueOnError)
+	config.registerFlags(resolved)
+	var errs []string
+	resolved.VisitAll(func(f *flag.Flag) {
+		if value, ok := lookupEnv(envName(f.Name)); ok {
+			if err := resolved.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", envName(f.Name), err))
+			}
+		}
+	})
+	flags.Visit(func(f *flag.Flag) {
+		if resolved.Lookup(f.Name) != nil {
+			resolved.Set(f.Name, f.Value.String())
+		}
+	})
+	if len(errs) > 0 {
+		return nil, false, fmt.Errorf("invalid env: %s", strings.Join(errs, "; "))
+	}
+	if err := config.Validate(); err != nil {
+		return nil, false, err
+	}
+	return config, printConfig, nil
+}
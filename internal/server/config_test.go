@@ -0,0 +1,121 @@
+package server_test
+
+import (
+	"github.com/autom8ter/thermomatic/internal/server"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//TestLoadConfig fails if settings aren't resolved in order of precedence: flags, env, file, defaults
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"tcpPort": 9000, "httpPort": 9001, "readTimeout": "5s", "onlineWindow": "1m"}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	env := map[string]string{
+		"THERMOMATIC_CONFIG":    path,
+		"THERMOMATIC_HTTP_PORT": "9002",
+		"THERMOMATIC_TCP_PORT":  "9003",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+	config, printConfig, err := server.LoadConfig([]string{"-tcp-port", "9004", "-print-config"}, lookupEnv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !printConfig {
+		t.Error("expected print-config to be set")
+	}
+	if config.TcpPort != 9004 {
+		t.Errorf("expected tcp port from flags actual = %v", config.TcpPort)
+	}
+	if config.HttpPort != 9002 {
+		t.Errorf("expected http port from env actual = %v", config.HttpPort)
+	}
+	if time.Duration(config.ReadTimeout) != 5*time.Second || time.Duration(config.OnlineWindow) != time.Minute {
+		t.Errorf("expected timeouts from file actual = %s %s", config.ReadTimeout, config.OnlineWindow)
+	}
+	if time.Duration(config.LoginTimeout) != time.Second {
+		t.Errorf("expected default login timeout actual = %s", config.LoginTimeout)
+	}
+}
+
+//TestLoadConfigListeners fails if listeners from the config file aren't kept, or aren't replaced by the listeners flag
+func TestLoadConfigListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	file := `{"listeners": [{"name": "gateway", "network": "unix", "address": "/tmp/thermomatic.sock", "readTimeout": "10s"}]}`
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	noEnv := func(string) (string, bool) { return "", false }
+	config, _, err := server.LoadConfig([]string{"-config", path}, noEnv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(config.Listeners) != 1 || config.Listeners[0].Name != "gateway" || time.Duration(config.Listeners[0].ReadTimeout) != 10*time.Second {
+		t.Fatalf("expected listener from file actual = %+v", config.Listeners)
+	}
+	config, _, err = server.LoadConfig([]string{"-config", path, "-listeners", "tcp:127.0.0.1:9005,unix:/tmp/gateway.sock"}, noEnv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []server.ListenerConfig{
+		{Network: "tcp", Address: "127.0.0.1:9005"},
+		{Network: "unix", Address: "/tmp/gateway.sock"},
+	}
+	if len(config.Listeners) != len(expected) || config.Listeners[0] != expected[0] || config.Listeners[1] != expected[1] {
+		t.Fatalf("expected listeners from flags actual = %+v", config.Listeners)
+	}
+}
+
+//TestConfigValidate fails if an invalid config isn't reported with every offending setting
+func TestConfigValidate(t *testing.T) {
+	if err := server.DefaultConfig().Validate(); err != nil {
+		t.Fatalf("expected default config to be valid: %s", err)
+	}
+	config := server.DefaultConfig()
+	config.TcpPort = 70000
+	config.ReadTimeout = 0
+	config.MaxInvalidRatio = 0.5
+	config.TCPKeepAlive = -1
+	config.OutputOverflow = "drop"
+	config.LastKnownRetention = server.Duration(time.Second)
+	config.ValidationProfiles = []server.ValidationProfile{
+		{Name: "furnace", TACPrefixes: []string{"49015420"}},
+		{Name: "furnace", IMEIs: []uint64{490154203237518}},
+		{Name: "unselected"},
+	}
+	config.Listeners = []server.ListenerConfig{
+		{Network: "udp", Address: ":9000"},
+		{Name: "default", Network: "unix", Address: "/tmp/thermomatic.sock"},
+	}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("expected invalid config")
+	}
+	for _, setting := range []string{"tcpPort", "readTimeout", "invalidWindow", "tcpKeepAlive", "outputOverflow", "lastKnownRetention", "validationProfiles[1].name", "validationProfiles[2]", "listeners[0].network", "listeners[1].name"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("expected %s in error: %s", setting, err)
+		}
+	}
+	noEnv := func(string) (string, bool) { return "", false }
+	if _, _, err := server.LoadConfig([]string{"-read-timeout", "soon"}, noEnv); err == nil {
+		t.Error("expected invalid duration flag to fail")
+	}
+}
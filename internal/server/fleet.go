@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/autom8ter/thermomatic/internal/client"
+	"github.com/autom8ter/thermomatic/internal/common"
+	"sync"
+	"time"
+)
+
+//fleetTotals sums the traffic & quality counters of device connections
+type fleetTotals struct {
+	bytesRead uint64
+	valid     uint64
+	invalid   client.FieldCounts
+	rejected  client.FieldCounts
+	gaps      uint64
+	dupes     uint64
+	corrupt   uint64
+}
+
+func (t *fleetTotals) add(m *client.Metrics) {
+	t.bytesRead += m.BytesRead
+	t.valid += m.ValidReadings
+	for field, count := range m.InvalidReadings {
+		t.invalid[field] += count
+	}
+	for field, count := range m.RejectedFields {
+		t.rejected[field] += count
+	}
+	t.gaps += m.SequenceGaps
+	t.dupes += m.DuplicateFrames
+	t.corrupt += m.CorruptFrames
+}
+
+//fleet keeps the totals of closed device connections, so the fleet's counters don't drop as devices disconnect
+type fleet struct {
+	mu     sync.Mutex
+	closed fleetTotals
+}
+
+//retire adds the metrics of a closed connection to the fleet's totals
+func (f *fleet) retire(m client.Metrics) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed.add(&m)
+}
+
+//fleetMetrics aggregates the metrics of every closed & logged in device connection
+func (s *server) fleetMetrics() common.FleetMetrics {
+	s.fleet.mu.Lock()
+	totals := s.fleet.closed
+	s.fleet.mu.Unlock()
+	var (
+		loggedIn, withInterval int
+		loginLatency, interval time.Duration
+	)
+	s.devices.eachSession(func(c client.ClientConn) {
+		m := c.Metrics()
+		totals.add(&m)
+		loggedIn++
+		loginLatency += m.LoginLatency
+		if m.MessageInterval > 0 {
+			withInterval++
+			interval += m.MessageInterval
+		}
+	})
+	metrics := common.FleetMetrics{
+		BytesRead:       totals.bytesRead,
+		ValidReadings:   totals.valid,
+		InvalidReadings: make(map[string]uint64, len(totals.invalid)),
+		RejectedFields:  make(map[string]uint64, len(totals.rejected)),
+		SequenceGaps:    totals.gaps,
+		DuplicateFrames: totals.dupes,
+		CorruptFrames:   totals.corrupt,
+	}
+	for field, count := range totals.invalid {
+		metrics.InvalidReadings[client.Field(field).String()] = count
+	}
+	for field, count := range totals.rejected {
+		metrics.RejectedFields[client.Field(field).String()] = count
+	}
+	if loggedIn > 0 {
+		metrics.MeanLoginLatencyMs = milliseconds(loginLatency / time.Duration(loggedIn))
+	}
+	if withInterval > 0 {
+		metrics.MeanMessageIntervalMs = milliseconds(interval / time.Duration(withInterval))
+	}
+	return metrics
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
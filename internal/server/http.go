@@ -2,15 +2,19 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/client"
 	"github.com/autom8ter/thermomatic/internal/common"
+	"github.com/autom8ter/thermomatic/internal/imei"
 	"net/http"
 	"net/http/pprof"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
-func (s server) setupRoutes() {
+func (s *server) setupRoutes() {
 	s.mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 	s.mux.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
 	s.mux.Handle("/debug/pps.muxof/profile", http.HandlerFunc(pprof.Profile))
@@ -19,9 +23,12 @@ func (s server) setupRoutes() {
 	s.mux.HandleFunc("/status", s.handleStatus())
 	s.mux.HandleFunc("/readings", s.handleReading())
 	s.mux.HandleFunc("/stats", s.handleStats())
+	s.mux.HandleFunc("/health", s.handleHealth())
+	s.mux.HandleFunc("/quarantine", s.handleQuarantine())
+	s.mux.HandleFunc("/devices/", s.handleDevices())
 }
 
-func (s server) handleStatus() http.HandlerFunc {
+func (s *server) handleStatus() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "expecting method: GET", http.StatusMethodNotAllowed)
@@ -38,8 +45,8 @@ func (s server) handleStatus() http.HandlerFunc {
 			return
 		}
 		if reading, ok := s.GetReading(uid); ok {
-			//if a reading has been stored in the past 5 minutes, return 200
-			if time.Since(reading.Timestamp) < 5*time.Minute {
+			//if a reading has been stored within the online window, return 200
+			if time.Since(reading.Timestamp) < time.Duration(s.config.OnlineWindow) {
 				w.WriteHeader(http.StatusOK)
 			}
 		} else {
@@ -49,7 +56,7 @@ func (s server) handleStatus() http.HandlerFunc {
 	}
 }
 
-func (s server) handleReading() http.HandlerFunc {
+func (s *server) handleReading() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "expecting method: GET", http.StatusMethodNotAllowed)
@@ -66,7 +73,7 @@ func (s server) handleReading() http.HandlerFunc {
 			return
 		}
 		if reading, ok := s.GetReading(uid); ok {
-			if err := json.NewEncoder(w).Encode(reading); err != nil {
+			if err := json.NewEncoder(w).Encode(&reading); err != nil {
 				s.serverLog.Printf("failed to encode reading = %s", err.Error())
 				http.Error(w, "failed to encode reading", http.StatusInternalServerError)
 				return
@@ -79,18 +86,32 @@ func (s server) handleReading() http.HandlerFunc {
 }
 
 //handleStats serves health related metrics.
-func (s server) handleStats() http.HandlerFunc {
+func (s *server) handleStats() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "expecting method: GET", http.StatusMethodNotAllowed)
 			return
 		}
+		connections, pending := s.limits.counts()
 		stats := &common.Stats{
 			GoRoutines:        runtime.NumGoroutine(),
 			ClientConnections: s.TotalClients(),
+			Connections:       connections,
+			PendingLogins:     pending,
+			Rejected:          s.rejected.snapshot(),
+			DuplicateLogins:   s.duplicates.snapshot(),
+			States:            s.states.snapshot(),
+			Disconnects:       s.disconnects.snapshot(),
+			Fleet:             s.fleetMetrics(),
+			Quarantined:       len(s.quarantined.list(time.Now())),
+			Output:            s.output.stats(),
+			Listeners:         map[string]common.ListenerStats{},
 			CPUs:              runtime.NumCPU(),
 			Version:           runtime.Version(),
 		}
+		for _, l := range s.listeners {
+			stats.Listeners[l.config.name()] = l.stats()
+		}
 
 		if err := json.NewEncoder(w).Encode(stats); err != nil {
 			s.serverLog.Printf("failed to encode stats = %s", err.Error())
@@ -99,3 +120,173 @@ func (s server) handleStats() http.HandlerFunc {
 		}
 	}
 }
+
+//handleHealth serves the server's health. It responds with 503 once any device listener has stopped accepting
+//connections
+func (s *server) handleHealth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "expecting method: GET", http.StatusMethodNotAllowed)
+			return
+		}
+		health := common.Health{Status: "ok"}
+		for _, l := range s.listeners {
+			if err := l.failed(); err != nil {
+				if health.FailedListeners == nil {
+					health.FailedListeners = map[string]string{}
+				}
+				health.Status = "failing"
+				health.FailedListeners[l.config.name()] = err.Error()
+			}
+		}
+		if health.FailedListeners != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(&health); err != nil {
+			s.serverLog.Printf("failed to encode health = %s", err.Error())
+		}
+	}
+}
+
+//handleQuarantine serves every quarantined device, or the quarantine status of a single device given its imei
+func (s *server) handleQuarantine() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "expecting method: GET", http.StatusMethodNotAllowed)
+			return
+		}
+		var body interface{}
+		if id := r.URL.Query().Get("imei"); id != "" {
+			uid, err := strconv.ParseUint(id, 0, 64)
+			if err != nil {
+				http.Error(w, "invalid uid", http.StatusBadRequest)
+				return
+			}
+			entry, ok := s.quarantined.get(uid, time.Now())
+			if !ok {
+				http.Error(w, "device not quarantined", http.StatusNotFound)
+				return
+			}
+			body = entry
+		} else {
+			body = s.quarantined.list(time.Now())
+		}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			s.serverLog.Printf("failed to encode quarantine = %s", err.Error())
+			http.Error(w, "failed to encode quarantine", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+//parseIMEI decodes an imei & validates it like a device's login message
+func parseIMEI(s string) (uint64, error) {
+	if len(s) != common.MinImeiLength {
+		return 0, fmt.Errorf("expecting %v digits", common.MinImeiLength)
+	}
+	return imei.Decode([]byte(s))
+}
+
+//commandRequest is the body of POST /devices/{imei}/commands. Arg is the interval in seconds of set_interval commands
+type commandRequest struct {
+	Type client.CommandType `json:"type"`
+	Arg  uint32             `json:"arg"`
+}
+
+//handleDevices serves the last known record of a device with GET /devices/{imei}. The device's commands are served
+//by serveCommands when the command channel is enabled
+func (s *server) handleDevices() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 2 || len(parts) > 4 || len(parts) > 2 && (parts[2] != "commands" || !s.config.Commands) {
+			http.NotFound(w, r)
+			return
+		}
+		uid, err := strconv.ParseUint(parts[1], 0, 64)
+		if err != nil {
+			http.Error(w, "invalid uid", http.StatusBadRequest)
+			return
+		}
+		if len(parts) > 2 {
+			//commands are only kept for imeis a device could log in with
+			if uid, err = parseIMEI(parts[1]); err != nil {
+				http.Error(w, fmt.Sprintf("invalid imei: %s", err), http.StatusBadRequest)
+				return
+			}
+			s.serveCommands(w, r, uid, parts[3:])
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "expecting method: GET", http.StatusMethodNotAllowed)
+			return
+		}
+		record, ok := s.deviceRecord(uid)
+		if !ok {
+			http.Error(w, "device not found", http.StatusNotFound)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(&record); err != nil {
+			s.serverLog.Printf("failed to encode device = %s", err.Error())
+			http.Error(w, "failed to encode device", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+//serveCommands queues commands for a device with POST /devices/{imei}/commands, and serves the delivery status of the
+//device's most recent commands with GET /devices/{imei}/commands or GET /devices/{imei}/commands/{id}
+func (s *server) serveCommands(w http.ResponseWriter, r *http.Request, uid uint64, path []string) {
+	var body interface{}
+	switch {
+	case len(path) == 1:
+		if r.Method != http.MethodGet {
+			http.Error(w, "expecting method: GET", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(path[0], 10, 32)
+		if err != nil {
+			http.Error(w, "invalid command id", http.StatusBadRequest)
+			return
+		}
+		status, ok := s.commands.get(uid, uint32(id))
+		if !ok {
+			http.Error(w, "command not found", http.StatusNotFound)
+			return
+		}
+		body = status
+	case r.Method == http.MethodGet:
+		body = s.commands.list(uid)
+	case r.Method == http.MethodPost:
+		var req commandRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid command: %s", err), http.StatusBadRequest)
+			return
+		}
+		if !req.Type.Valid() {
+			http.Error(w, "invalid command: type must be set_interval, request_status or reboot", http.StatusBadRequest)
+			return
+		}
+		if req.Type == client.CommandSetInterval && req.Arg == 0 {
+			http.Error(w, "invalid command: set_interval requires an interval in seconds", http.StatusBadRequest)
+			return
+		}
+		status, err := s.commands.enqueue(uid, req.Type, req.Arg)
+		if err != nil {
+			s.serverLog.Printf("[WARN] %v command rejected: %s", uid, err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		s.serverLog.Printf("[INFO] %v queued command %v: %s", uid, status.ID, status.Type)
+		s.deliveries.start(func() { s.deliver(uid) })
+		w.WriteHeader(http.StatusAccepted)
+		body = status
+	default:
+		http.Error(w, "expecting method: GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.serverLog.Printf("failed to encode commands = %s", err.Error())
+		http.Error(w, "failed to encode commands", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"github.com/autom8ter/thermomatic/internal/client"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+//session is a stub client.ClientConn
+type session struct {
+	conn    net.Conn
+	imei    uint64
+	closed  bool
+	reason  client.CloseReason
+	metrics client.Metrics
+}
+
+func newSession(imei uint64) *session {
+	conn, peer := net.Pipe()
+	peer.Close()
+	return &session{conn: conn, imei: imei}
+}
+
+func (s *session) GetConn() net.Conn               { return s.conn }
+func (s *session) SetIMEI(code uint64)             { s.imei = code }
+func (s *session) GetIMEI() uint64                 { return s.imei }
+func (s *session) GetManager() client.Manager      { return nil }
+func (s *session) Connect(ctx context.Context)     {}
+func (s *session) Close(reason client.CloseReason) { s.closed = true; s.reason = reason }
+func (s *session) CloseReason() client.CloseReason { return s.reason }
+func (s *session) State() client.State             { return client.StateActive }
+func (s *session) Metrics() client.Metrics         { return s.metrics }
+func (s *session) Send(cmd client.Command) error   { return nil }
+func (s *session) StateEntered(state client.State) time.Time {
+	return time.Time{}
+}
+
+func newTestServer(policy string) *server {
+	config := DefaultConfig()
+	config.DuplicateLoginPolicy = policy
+	logger := log.New(ioutil.Discard, "", 0)
+	return newServer(config, logger, logger)
+}
+
+//TestDuplicateLogin fails if a duplicate login isn't handled according to the configured policy, or if one session's
+//teardown removes another session or loses its counters
+func TestDuplicateLogin(t *testing.T) {
+	const imei = 450154603277518
+	t.Run(DuplicateLoginReject, func(t *testing.T) {
+		s := newTestServer(DuplicateLoginReject)
+		first, second := newSession(imei), newSession(imei)
+		if err := s.AddClient(first); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := s.AddClient(second); err == nil {
+			t.Fatal("expected duplicate login to be rejected")
+		}
+		if s.RemoveClient(second) {
+			t.Fatal("expected rejected session removal to be ignored")
+		}
+		if s.TotalClients() != 1 || s.duplicates.snapshot()["rejected"] != 1 {
+			t.Fatalf("expected first session to remain online")
+		}
+	})
+	t.Run(DuplicateLoginEvict, func(t *testing.T) {
+		s := newTestServer(DuplicateLoginEvict)
+		first, second := newSession(imei), newSession(imei)
+		if err := s.AddClient(first); err != nil {
+			t.Fatal(err.Error())
+		}
+		first.metrics.ValidReadings = 2
+		if err := s.AddClient(second); err != nil {
+			t.Fatal(err.Error())
+		}
+		if !first.closed || first.reason != client.CloseEvicted {
+			t.Fatal("expected first session to be evicted")
+		}
+		//the evicted session's readings are counted as soon as it's evicted
+		if record, _ := s.deviceRecord(imei); record.ValidReadings != 2 {
+			t.Fatalf("expected the evicted session's readings to be counted actual = %v", record.ValidReadings)
+		}
+		//the evicted session's teardown must not remove the new session, readings it handled while closing are counted
+		first.metrics.ValidReadings = 3
+		if s.RemoveClient(first) {
+			t.Fatal("expected evicted session removal to be ignored")
+		}
+		if record, _ := s.deviceRecord(imei); record.ValidReadings != 3 || len(s.known.evicted) != 0 {
+			t.Fatalf("expected the evicted session's readings to be counted once actual = %v", record.ValidReadings)
+		}
+		if s.TotalClients() != 1 || !s.RemoveClient(second) {
+			t.Fatal("expected second session to be the last session online")
+		}
+	})
+	t.Run(DuplicateLoginAllow, func(t *testing.T) {
+		s := newTestServer(DuplicateLoginAllow)
+		first, second := newSession(imei), newSession(imei)
+		if err := s.AddClient(first); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := s.AddClient(second); err != nil {
+			t.Fatal(err.Error())
+		}
+		if s.TotalClients() != 2 {
+			t.Fatalf("expected 2 sessions actual = %v", s.TotalClients())
+		}
+		if s.RemoveClient(first) {
+			t.Fatal("expected second session to remain online")
+		}
+		if !s.RemoveClient(second) {
+			t.Fatal("expected second session to be the last session")
+		}
+	})
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/client"
+	"github.com/autom8ter/thermomatic/internal/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//lastKnownInterval is how often expired last known records are pruned & the records are saved to the last known file
+const lastKnownInterval = time.Minute
+
+//lastKnown keeps a record of every device that has logged in. A device that reconnects within the grace window
+//continues its previous session: its connected time & counters are carried over. The record of a device that has been
+//offline for longer than the retention is pruned
+type lastKnown struct {
+	mu        sync.Mutex
+	grace     time.Duration
+	retention time.Duration
+	records   map[uint64]*common.DeviceRecord
+	//evicted holds the metrics of evicted sessions that haven't been retired yet, as they were when they were evicted
+	evicted map[client.ClientConn]client.Metrics
+}
+
+func newLastKnown(grace, retention time.Duration) *lastKnown {
+	return &lastKnown{
+		grace:     grace,
+		retention: retention,
+		records:   map[uint64]*common.DeviceRecord{},
+		evicted:   map[client.ClientConn]client.Metrics{},
+	}
+}
+
+//online records the login of c. It reports whether the device reconnected within the grace window
+func (k *lastKnown) online(c client.ClientConn, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	imei := c.GetIMEI()
+	r, ok := k.records[imei]
+	if ok && r.Online {
+		//another session of a device that's already online
+		return false
+	}
+	resumed := ok && now.Sub(r.DisconnectedAt) <= k.grace
+	if !resumed {
+		r = &common.DeviceRecord{IMEI: imei, ConnectedAt: now}
+		k.records[imei] = r
+	} else {
+		r.Reconnects++
+	}
+	r.Online = true
+	r.RemoteAddr = c.GetConn().RemoteAddr().String()
+	r.DisconnectedAt = time.Time{}
+	r.DisconnectReason = ""
+	return resumed
+}
+
+//evict adds the counters of a session evicted by a duplicate login to the device's record right away, since the
+//session no longer counts as one of the device's live sessions
+func (k *lastKnown) evict(c client.ClientConn) {
+	m := c.Metrics()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.evicted[c] = m
+	if r, ok := k.records[c.GetIMEI()]; ok {
+		addMetrics(r, m)
+	}
+}
+
+//retire adds the counters of a closed session to the device's record. Only the counters an evicted session gained
+//while closing are added
+func (k *lastKnown) retire(c client.ClientConn) {
+	m := c.Metrics()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if evicted, ok := k.evicted[c]; ok {
+		delete(k.evicted, c)
+		m = metricsSince(m, evicted)
+	}
+	if r, ok := k.records[c.GetIMEI()]; ok {
+		addMetrics(r, m)
+	}
+}
+
+//offline records that the device's last session was closed for the given reason
+func (k *lastKnown) offline(imei uint64, reason client.CloseReason, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if r, ok := k.records[imei]; ok {
+		r.Online = false
+		r.DisconnectedAt = now
+		r.DisconnectReason = reason.String()
+	}
+}
+
+//expired reports whether the device is still offline & its grace window has passed
+func (k *lastKnown) expired(imei uint64, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	r, ok := k.records[imei]
+	return !ok || !r.Online && now.Sub(r.DisconnectedAt) >= k.grace
+}
+
+//prune removes the records of devices that have been offline for longer than the retention. It returns the number of
+//records removed
+func (k *lastKnown) prune(now time.Time) int {
+	if k.retention <= 0 {
+		return 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pruned := 0
+	for imei, r := range k.records {
+		if !r.Online && now.Sub(r.DisconnectedAt) > k.retention {
+			delete(k.records, imei)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+//get returns a copy of the device's record
+func (k *lastKnown) get(imei uint64) (common.DeviceRecord, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	r, ok := k.records[imei]
+	if !ok {
+		return common.DeviceRecord{}, false
+	}
+	return *r, true
+}
+
+//addMetrics adds the counters of a session to the record
+func addMetrics(r *common.DeviceRecord, m client.Metrics) {
+	r.BytesRead += m.BytesRead
+	r.ValidReadings += m.ValidReadings
+	for _, count := range m.InvalidReadings {
+		r.InvalidReadings += count
+	}
+	r.SequenceGaps += m.SequenceGaps
+	r.DuplicateFrames += m.DuplicateFrames
+	r.CorruptFrames += m.CorruptFrames
+	r.BackfilledReadings += m.BackfilledReadings
+	if m.LastSeen.After(r.LastSeen) {
+		r.LastSeen = m.LastSeen
+		r.Protocol = m.Protocol
+		r.ClockSkewMs = milliseconds(m.ClockSkew)
+	}
+}
+
+//metricsSince returns the session's metrics less the counters of an earlier snapshot of them
+func metricsSince(m, snapshot client.Metrics) client.Metrics {
+	m.BytesRead -= snapshot.BytesRead
+	m.ValidReadings -= snapshot.ValidReadings
+	for field := range m.InvalidReadings {
+		m.InvalidReadings[field] -= snapshot.InvalidReadings[field]
+	}
+	m.SequenceGaps -= snapshot.SequenceGaps
+	m.DuplicateFrames -= snapshot.DuplicateFrames
+	m.CorruptFrames -= snapshot.CorruptFrames
+	m.BackfilledReadings -= snapshot.BackfilledReadings
+	return m
+}
+
+//load reads the records saved at path. A missing file is ignored. Devices are loaded as offline, records past the
+//retention are dropped
+func (k *lastKnown) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load last known devices: %s", err)
+	}
+	var records []*common.DeviceRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("load last known devices: %s: %s", path, err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, r := range records {
+		if r.Online {
+			//the server exited without recording the disconnect
+			r.Online = false
+			r.DisconnectedAt = r.LastSeen
+			r.DisconnectReason = client.CloseServerShutdown.String()
+		}
+		if k.retention <= 0 || time.Since(r.DisconnectedAt) <= k.retention {
+			k.records[r.IMEI] = r
+		}
+	}
+	return nil
+}
+
+//save writes every record to path. The file is replaced atomically so a crash never leaves a partial file behind
+func (k *lastKnown) save(path string) error {
+	k.mu.Lock()
+	records := make([]common.DeviceRecord, 0, len(k.records))
+	for _, r := range k.records {
+		records = append(records, *r)
+	}
+	k.mu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].IMEI < records[j].IMEI })
+	b, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("save last known devices: %s", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("save last known devices: %s", err)
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("save last known devices: %s", err)
+	}
+	return nil
+}
+
+//deviceRecord returns the device's record including the counters of its live sessions
+func (s *server) deviceRecord(imei uint64) (common.DeviceRecord, bool) {
+	r, ok := s.known.get(imei)
+	if !ok {
+		return r, false
+	}
+	for _, c := range s.devices.sessionsOf(imei) {
+		addMetrics(&r, c.Metrics())
+	}
+	return r, true
+}
+
+//expiries holds a timer per offline device that forgets its cached reading once the device's grace window has passed.
+//Once stopped no timer fires, so none outlives the server
+type expiries struct {
+	mu      sync.Mutex
+	stopped bool
+	timers  map[uint64]*time.Timer
+}
+
+func newExpiries() *expiries {
+	return &expiries{timers: map[uint64]*time.Timer{}}
+}
+
+//schedule runs expire after d unless the device disconnects again before, which schedules a new timer in its place
+func (e *expiries) schedule(imei uint64, d time.Duration, expire func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopped {
+		return
+	}
+	if t, ok := e.timers[imei]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		e.mu.Lock()
+		current := e.timers[imei] == t
+		if current {
+			delete(e.timers, imei)
+		}
+		e.mu.Unlock()
+		if current {
+			expire()
+		}
+	})
+	e.timers[imei] = t
+}
+
+//stop cancels every timer & prevents new ones from being scheduled
+func (e *expiries) stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stopped = true
+	for imei, t := range e.timers {
+		t.Stop()
+		delete(e.timers, imei)
+	}
+}
+
+//expireReading forgets the device's cached reading once its grace window has passed without it reconnecting
+func (s *server) expireReading(imei uint64) {
+	if s.known.expired(imei, time.Now()) {
+		s.devices.expireReading(imei)
+	}
+}
+
+//maintainLastKnown periodically prunes expired last known records & saves the rest until ctx is cancelled
+func (s *server) maintainLastKnown(ctx context.Context) {
+	ticker := time.NewTicker(lastKnownInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if pruned := s.known.prune(time.Now()); pruned > 0 {
+				s.serverLog.Printf("[INFO] pruned %v last known device records offline for longer than %s", pruned, s.known.retention)
+			}
+			if s.config.LastKnownFile == "" {
+				continue
+			}
+			if err := s.known.save(s.config.LastKnownFile); err != nil {
+				s.serverLog.Printf("[ERROR] %s", err.Error())
+			}
+		}
+	}
+}
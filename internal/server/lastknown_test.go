@@ -0,0 +1,79 @@
+package server
+
+import (
+	"github.com/autom8ter/thermomatic/internal/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//TestLastKnownPrune fails if the records of devices offline for longer than the retention are kept, or are loaded
+//from the last known file
+func TestLastKnownPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.json")
+	now := time.Now()
+	k := newLastKnown(time.Second, time.Hour)
+	k.records = map[uint64]*common.DeviceRecord{
+		1: {IMEI: 1, Online: true, LastSeen: now.Add(-2 * time.Hour)},
+		2: {IMEI: 2, DisconnectedAt: now.Add(-30 * time.Minute)},
+		3: {IMEI: 3, DisconnectedAt: now.Add(-2 * time.Hour)},
+	}
+	if err := k.save(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pruned := k.prune(now); pruned != 1 {
+		t.Fatalf("expected 1 record to be pruned actual = %v", pruned)
+	}
+	if _, ok := k.get(3); ok {
+		t.Fatal("expected the record of a device offline past the retention to be pruned")
+	}
+	if _, ok := k.get(1); !ok {
+		t.Fatal("expected the record of an online device to be kept")
+	}
+	//the device that was online when the records were saved is loaded as offline since it was last seen
+	loaded := newLastKnown(time.Second, time.Hour)
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(loaded.records) != 1 || loaded.records[2] == nil {
+		t.Fatalf("expected only the record within the retention to be loaded actual = %v records", len(loaded.records))
+	}
+	//a zero retention keeps every record
+	forever := newLastKnown(time.Second, 0)
+	if err := forever.load(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pruned := forever.prune(now.Add(24 * time.Hour)); pruned != 0 || len(forever.records) != 3 {
+		t.Fatalf("expected every record to be kept actual = %v records", len(forever.records))
+	}
+}
+
+//TestExpiries fails if a device's earlier timer isn't replaced when it disconnects again, or if a timer fires or is
+//scheduled once the expiries are stopped
+func TestExpiries(t *testing.T) {
+	e := newExpiries()
+	expired := make(chan int, 3)
+	e.schedule(1, time.Hour, func() { expired <- 1 })
+	e.schedule(1, time.Millisecond, func() { expired <- 2 })
+	if got := <-expired; got != 2 {
+		t.Fatalf("expected the latest timer to fire actual = %v", got)
+	}
+	e.schedule(2, 50*time.Millisecond, func() { expired <- 3 })
+	e.stop()
+	e.schedule(3, time.Millisecond, func() { expired <- 4 })
+	select {
+	case got := <-expired:
+		t.Fatalf("expected no timer to fire once stopped actual = %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(e.timers) != 0 {
+		t.Fatalf("expected no timers once stopped actual = %v", len(e.timers))
+	}
+}
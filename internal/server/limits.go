@@ -0,0 +1,199 @@
+package server
+
+import (
+	"github.com/autom8ter/thermomatic/internal/client"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//reasons a newly accepted connection is rejected, counted in /stats
+const (
+	rejectMaxConnections      = "max_connections"
+	rejectMaxConnectionsPerIP = "max_connections_per_ip"
+	rejectAcceptRate          = "accept_rate"
+	rejectMaxPendingLogins    = "max_pending_logins"
+)
+
+//limits bounds the resources consumed by device connections. Every accepted connection must be admitted before it
+//is served and released once it is closed.
+type limits struct {
+	mu         sync.Mutex
+	maxConns   int
+	maxPerIP   int
+	maxPending int
+	conns      int
+	perIP      map[string]int
+	//pending holds connections that have been admitted but haven't logged in yet
+	pending map[net.Conn]struct{}
+	rate    *rateLimiter
+}
+
+func newLimits(config *Config) *limits {
+	return &limits{
+		maxConns:   config.MaxConnections,
+		maxPerIP:   config.MaxConnectionsPerIP,
+		maxPending: config.MaxPendingLogins,
+		perIP:      map[string]int{},
+		pending:    map[net.Conn]struct{}{},
+		rate:       newRateLimiter(config.AcceptRate, config.AcceptBurst),
+	}
+}
+
+//admit reserves a connection slot for conn. If conn exceeds any limit, the reason it was rejected is returned
+func (l *limits) admit(conn net.Conn) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.rate.allow(time.Now()) {
+		return rejectAcceptRate, false
+	}
+	if l.maxConns > 0 && l.conns >= l.maxConns {
+		return rejectMaxConnections, false
+	}
+	ip := remoteIP(conn)
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return rejectMaxConnectionsPerIP, false
+	}
+	if l.maxPending > 0 && len(l.pending) >= l.maxPending {
+		return rejectMaxPendingLogins, false
+	}
+	l.conns++
+	l.perIP[ip]++
+	l.pending[conn] = struct{}{}
+	return "", true
+}
+
+//loggedIn frees the pre-login slot held by conn
+func (l *limits) loggedIn(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending, conn)
+}
+
+//release frees every slot held by conn
+func (l *limits) release(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending, conn)
+	l.conns--
+	ip := remoteIP(conn)
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
+
+//counts returns the number of open connections and how many of them haven't logged in yet
+func (l *limits) counts() (conns int, pending int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns, len(l.pending)
+}
+
+//remoteIP returns the host portion of the connection's remote address. Addresses without a host(ex: unix sockets) are
+//returned whole
+func remoteIP(conn net.Conn) string {
+	if conn.RemoteAddr() == nil {
+		return ""
+	}
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+//rateLimiter is a token bucket that refills at rate tokens per second up to burst tokens. A zero rate never limits.
+//rateLimiter isn't safe for concurrent use.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+//allow takes a token from the bucket if one is available
+func (r *rateLimiter) allow(now time.Time) bool {
+	if r.rate <= 0 {
+		return true
+	}
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+//counters is a set of named counters that is safe for concurrent use
+type counters struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newCounters() *counters {
+	return &counters{counts: map[string]uint64{}}
+}
+
+//inc increments the named counter
+func (c *counters) inc(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[name]++
+}
+
+//snapshot returns a copy of every counter
+func (c *counters) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := make(map[string]uint64, len(c.counts))
+	for name, count := range c.counts {
+		snapshot[name] = count
+	}
+	return snapshot
+}
+
+//stateGauges counts the connections in each state. Closed connections aren't counted
+type stateGauges struct {
+	counts [client.StateClosed]int64
+}
+
+//transition moves a connection from one state to another. A connection's initial state is reported with from equal
+//to to(see client.StateObserver)
+func (g *stateGauges) transition(from, to client.State) {
+	if from != to && from < client.StateClosed {
+		atomic.AddInt64(&g.counts[from], -1)
+	}
+	if to < client.StateClosed {
+		atomic.AddInt64(&g.counts[to], 1)
+	}
+}
+
+//snapshot returns the gauges keyed by state name
+func (g *stateGauges) snapshot() map[string]int64 {
+	snapshot := make(map[string]int64, len(g.counts))
+	for state := range g.counts {
+		snapshot[client.State(state).String()] = atomic.LoadInt64(&g.counts[state])
+	}
+	return snapshot
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+//TestLimits fails if connections exceeding the per ip or pending login caps are admitted, or if released slots
+//aren't reusable
+func TestLimits(t *testing.T) {
+	l := newLimits(&Config{MaxConnectionsPerIP: 2, MaxPendingLogins: 1})
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		defer peer.Close()
+		conns = append(conns, conn)
+	}
+	if _, ok := l.admit(conns[0]); !ok {
+		t.Fatal("expected first connection to be admitted")
+	}
+	if reason, ok := l.admit(conns[1]); ok || reason != rejectMaxPendingLogins {
+		t.Fatalf("expected %s actual = %s", rejectMaxPendingLogins, reason)
+	}
+	l.loggedIn(conns[0])
+	if _, ok := l.admit(conns[1]); !ok {
+		t.Fatal("expected second connection to be admitted after login")
+	}
+	l.loggedIn(conns[1])
+	if reason, ok := l.admit(conns[2]); ok || reason != rejectMaxConnectionsPerIP {
+		t.Fatalf("expected %s actual = %s", rejectMaxConnectionsPerIP, reason)
+	}
+	l.release(conns[0])
+	if _, ok := l.admit(conns[2]); !ok {
+		t.Fatal("expected third connection to be admitted after release")
+	}
+	if conns, pending := l.counts(); conns != 2 || pending != 1 {
+		t.Fatalf("expected 2 connections & 1 pending login actual = %v %v", conns, pending)
+	}
+}
+
+//TestRateLimiter fails if the token bucket doesn't allow bursts or refill at its rate
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(10, 2)
+	now := time.Now()
+	if !r.allow(now) || !r.allow(now) {
+		t.Fatal("expected burst of 2 to be allowed")
+	}
+	if r.allow(now) {
+		t.Fatal("expected empty bucket to limit")
+	}
+	if !r.allow(now.Add(100 * time.Millisecond)) {
+		t.Fatal("expected bucket to refill after 100ms")
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/client"
+	"github.com/autom8ter/thermomatic/internal/common"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//defaultListener is the name of the TcpAddr:TcpPort device listener
+const defaultListener = "default"
+
+//deviceListener accepts device connections on a single address. Its connections are subject to both the listener's
+//and the server's limits.
+type deviceListener struct {
+	config ListenerConfig
+	lis    net.Listener
+	limits *limits
+	//rejected counts connections rejected by either the listener's or the server's limits
+	rejected *counters
+	//options configure every client accepted by the listener
+	options []client.Option
+	//tcp are the socket options applied to every tcp connection accepted by the listener
+	tcp tcpOptions
+	//failure is the error that stopped the listener's accept loop, nil while it's serving
+	mu      sync.Mutex
+	failure error
+}
+
+func newDeviceListener(config ListenerConfig, server *Config, validators *validators) *deviceListener {
+	loginTimeout, readTimeout := config.LoginTimeout, config.ReadTimeout
+	if loginTimeout == 0 {
+		loginTimeout = server.LoginTimeout
+	}
+	if readTimeout == 0 {
+		readTimeout = server.ReadTimeout
+	}
+	l := &deviceListener{
+		config: config,
+		limits: newLimits(&Config{
+			MaxConnections:      config.MaxConnections,
+			MaxConnectionsPerIP: config.MaxConnectionsPerIP,
+			MaxPendingLogins:    config.MaxPendingLogins,
+			AcceptRate:          config.AcceptRate,
+			AcceptBurst:         config.AcceptBurst,
+		}),
+		rejected: newCounters(),
+		tcp:      newTCPOptions(server),
+		options: []client.Option{
+			client.WithLoginTimeout(time.Duration(loginTimeout)),
+			client.WithReadTimeout(time.Duration(readTimeout)),
+			client.WithInvalidReadingPolicy(client.InvalidReadingPolicy{
+				MaxConsecutive: server.MaxConsecutiveInvalid,
+				Window:         server.InvalidWindow,
+				MaxRatio:       server.MaxInvalidRatio,
+			}),
+			client.WithValidator(*validators.fallback),
+			client.WithValidatorSelector(validators.forIMEI),
+		},
+	}
+	if server.Commands {
+		l.options = append(l.options, client.WithCommands())
+	}
+	return l
+}
+
+//deviceListeners returns the default listener followed by every configured listener. The config must be valid
+func deviceListeners(config *Config) []*deviceListener {
+	//Validate builds the same validators, so they only fail to build for a config that was never validated
+	validators, err := newValidators(config.ValidationProfiles)
+	if err != nil {
+		panic(fmt.Sprintf("device listeners of an invalid config: %s", err))
+	}
+	listeners := []*deviceListener{newDeviceListener(ListenerConfig{
+		Name:    defaultListener,
+		Network: networkTCP,
+		Address: net.JoinHostPort(config.TcpAddr, strconv.Itoa(config.TcpPort)),
+	}, config, validators)}
+	for _, l := range config.Listeners {
+		listeners = append(listeners, newDeviceListener(l, config, validators))
+	}
+	return listeners
+}
+
+//listen binds the listener unless it was already supplied. A stale unix socket file left behind by a process that
+//exited without closing its listener is removed first
+func (l *deviceListener) listen(ctx context.Context) error {
+	if l.lis != nil {
+		return nil
+	}
+	if l.config.Network == networkUnix {
+		if info, err := os.Stat(l.config.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial(networkUnix, l.config.Address); err == nil {
+				conn.Close()
+				return fmt.Errorf("listener %s: %s is in use", l.config.name(), l.config.Address)
+			}
+			os.Remove(l.config.Address)
+		}
+	}
+	//keepalive is set on each connection as it's accepted(see tcpOptions)
+	lc := net.ListenConfig{KeepAlive: -1}
+	lis, err := lc.Listen(ctx, l.config.Network, l.config.Address)
+	if err != nil {
+		return fmt.Errorf("listener %s: %s", l.config.name(), err)
+	}
+	l.lis = lis
+	return nil
+}
+
+//fail records the error that stopped the listener's accept loop
+func (l *deviceListener) fail(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failure = err
+}
+
+//failed returns the error that stopped the listener's accept loop, if it has failed
+func (l *deviceListener) failed() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failure
+}
+
+//stats returns the listener's connection counts
+func (l *deviceListener) stats() common.ListenerStats {
+	connections, pending := l.limits.counts()
+	stats := common.ListenerStats{
+		Network:       l.config.Network,
+		Address:       l.config.Address,
+		Connections:   connections,
+		PendingLogins: pending,
+		Rejected:      l.rejected.snapshot(),
+	}
+	if l.lis != nil {
+		stats.Address = l.lis.Addr().String()
+	}
+	if err := l.failed(); err != nil {
+		stats.Error = err.Error()
+	} else {
+		stats.Serving = l.lis != nil
+	}
+	return stats
+}
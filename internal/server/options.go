@@ -0,0 +1,35 @@
+package server
+
+import (
+	"github.com/autom8ter/thermomatic/internal/client"
+	"net"
+)
+
+//Option configures a server created by NewServer
+type Option func(s *server)
+
+//WithDeviceListener makes the server accept device connections from lis instead of binding TcpAddr:TcpPort. The
+//listener is closed when the server is stopped
+func WithDeviceListener(lis net.Listener) Option {
+	return func(s *server) {
+		s.listeners[0].lis = lis
+	}
+}
+
+//WithHTTPListener makes the server serve the http api on lis instead of binding HttpAddr:HttpPort. The listener is
+//closed when the server is stopped
+func WithHTTPListener(lis net.Listener) Option {
+	return func(s *server) {
+		s.httpLis = lis
+	}
+}
+
+//WithClientOptions configures every client accepted by the server, ex: to add reading middleware. The options are
+//applied after the listener's timeouts
+func WithClientOptions(opts ...client.Option) Option {
+	return func(s *server) {
+		for _, l := range s.listeners {
+			l.options = append(l.options, opts...)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"github.com/autom8ter/thermomatic/internal/common"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//recordBufferSize is how many bytes of reading records are buffered before they're written to the output
+const recordBufferSize = 64 << 10
+
+//recordWriter writes reading records to an output, prefixing each record. Records are buffered & written to the output
+//once the buffer is full or Flush is called. It is safe for concurrent use and doesn't allocate once its buffer has
+//grown to fit the largest record.
+type recordWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newRecordWriter(out io.Writer, prefix string) *recordWriter {
+	return &recordWriter{
+		out:    out,
+		prefix: []byte(prefix),
+		buf:    make([]byte, 0, recordBufferSize+256),
+	}
+}
+
+//Write buffers the prefix & record, writing the buffer to the output once it's full
+func (w *recordWriter) Write(record []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(append(w.buf, w.prefix...), record...)
+	if len(w.buf) < recordBufferSize {
+		return len(record), nil
+	}
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+	return len(record), nil
+}
+
+//Flush writes any buffered records to the output
+func (w *recordWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+//flush writes the buffer to the output. The buffer is emptied even if the write fails, so a failing output doesn't
+//grow it without bound
+func (w *recordWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.out.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+//overflow policies of the output stage, deciding what happens to a record pushed while the queue is full
+const (
+	//OverflowBlock makes the connection wait until the queue has room
+	OverflowBlock = "block"
+	//OverflowDropNewest drops the pushed record
+	OverflowDropNewest = "drop-newest"
+	//OverflowDropOldest drops the oldest queued record to make room for the pushed record
+	OverflowDropOldest = "drop-oldest"
+)
+
+//blockSpins is how many times a blocked producer yields before it starts sleeping between retries
+const blockSpins = 64
+
+//outputStage decouples connections from the reading output: connections push records into a lock-free queue, which a
+//single writer drains into a recordWriter with batched writes. Pushing a record doesn't allocate.
+type outputStage struct {
+	queue    *ring
+	out      *recordWriter
+	overflow string
+	//interval is how often the writer flushes buffered records. Zero flushes whenever the queue is drained
+	interval time.Duration
+	//sleeping is set while the writer waits for records, wake wakes it up
+	sleeping int32
+	wake     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	pushed   uint64
+	dropped  uint64
+	written  uint64
+	errs     uint64
+	//onError is called with write errors from the writer goroutine
+	onError func(err error)
+}
+
+func newOutputStage(out *recordWriter, size int, overflow string, interval time.Duration, onError func(err error)) *outputStage {
+	return &outputStage{
+		queue:    newRing(size),
+		out:      out,
+		overflow: overflow,
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		onError:  onError,
+	}
+}
+
+//Write queues the record. If the queue is full the overflow policy decides whether the call blocks, or a record is
+//dropped. Dropped records aren't reported as errors, so a slow output doesn't disconnect devices
+func (o *outputStage) Write(record []byte) (int, error) {
+	atomic.AddUint64(&o.pushed, 1)
+	for spins := 0; !o.queue.push(record); spins++ {
+		switch o.overflow {
+		case OverflowDropNewest:
+			atomic.AddUint64(&o.dropped, 1)
+			return len(record), nil
+		case OverflowDropOldest:
+			if o.queue.pop(nil) {
+				atomic.AddUint64(&o.dropped, 1)
+			}
+		default:
+			o.signal()
+			if spins < blockSpins {
+				runtime.Gosched()
+			} else {
+				time.Sleep(50 * time.Microsecond)
+			}
+		}
+	}
+	o.signal()
+	return len(record), nil
+}
+
+//signal wakes the writer up if it's waiting for records
+func (o *outputStage) signal() {
+	if atomic.LoadInt32(&o.sleeping) == 1 && atomic.CompareAndSwapInt32(&o.sleeping, 1, 0) {
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//run drains the queue into the output until stop is called, flushing every interval or whenever the queue is drained
+//if there's no interval. Records still queued when stop is called are written before run returns
+func (o *outputStage) run() {
+	defer close(o.stopped)
+	var tick <-chan time.Time
+	if o.interval > 0 {
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	write := func(record []byte) {
+		if _, err := o.out.Write(record); err != nil {
+			o.error(err)
+		}
+		atomic.AddUint64(&o.written, 1)
+	}
+	for {
+		for o.queue.pop(write) {
+		}
+		if tick == nil {
+			o.flush()
+		}
+		atomic.StoreInt32(&o.sleeping, 1)
+		//a record pushed before the writer was marked as sleeping doesn't signal it
+		if o.queue.len() > 0 {
+			atomic.StoreInt32(&o.sleeping, 0)
+			continue
+		}
+		select {
+		case <-o.wake:
+		case <-tick:
+			atomic.StoreInt32(&o.sleeping, 0)
+			o.flush()
+		case <-o.done:
+			for o.queue.pop(write) {
+			}
+			o.flush()
+			return
+		}
+	}
+}
+
+func (o *outputStage) flush() {
+	if err := o.out.Flush(); err != nil {
+		o.error(err)
+	}
+}
+
+func (o *outputStage) error(err error) {
+	atomic.AddUint64(&o.errs, 1)
+	if o.onError != nil {
+		o.onError(err)
+	}
+}
+
+//stop writes every queued record & stops the writer. Records pushed after stop are queued but never written
+func (o *outputStage) stop() {
+	close(o.done)
+	<-o.stopped
+}
+
+//stats returns the stage's queue depth & counters
+func (o *outputStage) stats() common.OutputStats {
+	return common.OutputStats{
+		QueueDepth:    o.queue.len(),
+		QueueCapacity: o.queue.cap(),
+		Overflow:      o.overflow,
+		Pushed:        atomic.LoadUint64(&o.pushed),
+		Dropped:       atomic.LoadUint64(&o.dropped),
+		Written:       atomic.LoadUint64(&o.written),
+		WriteErrors:   atomic.LoadUint64(&o.errs),
+	}
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//countingWriter counts the writes made to a bytes.Buffer
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(b)
+}
+
+//TestRecordWriter fails if concurrent records are interleaved, buffered records aren't written once the buffer is full
+//or flushed, or writing a record allocates
+func TestRecordWriter(t *testing.T) {
+	const (
+		writers = 8
+		records = 1000
+		record  = "1257894000000000000,490154203237518,67.77,2.63555,33.41,44.4,0.25666\n"
+	)
+	out := &countingWriter{}
+	w := newRecordWriter(out, "")
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				w.Write([]byte(record))
+			}
+		}()
+	}
+	wg.Wait()
+	//the buffer is only written once it's full
+	if out.writes == 0 || out.Len()%len(record) != 0 || out.Len() < out.writes*recordBufferSize {
+		t.Fatalf("expected whole buffers of records to be written actual = %v bytes in %v writes", out.Len(), out.writes)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if out.String() != strings.Repeat(record, writers*records) {
+		t.Fatal("expected every record to be written whole")
+	}
+	if allocs := testing.AllocsPerRun(1000, func() { w.Write([]byte(record)) }); allocs != 0 {
+		t.Fatalf("expected writing a record not to allocate actual = %v allocs", allocs)
+	}
+	prefixed := &countingWriter{}
+	w = newRecordWriter(prefixed, "prefix: ")
+	w.Write([]byte(record))
+	w.Write([]byte(record))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if prefixed.writes != 1 || prefixed.String() != "prefix: "+record+"prefix: "+record {
+		t.Fatalf("expected prefixed records in a single write actual = %q", prefixed.String())
+	}
+}
+
+//TestRing fails if records aren't popped in the order they were pushed, or a full ring accepts a record
+func TestRing(t *testing.T) {
+	r := newRing(3)
+	if r.cap() != 4 {
+		t.Fatalf("expected capacity to be rounded up to 4 actual = %v", r.cap())
+	}
+	//go around the ring a few times
+	for lap := 0; lap < 3; lap++ {
+		for i := 0; i < r.cap(); i++ {
+			if !r.push([]byte{byte(i)}) {
+				t.Fatalf("expected push %v to succeed", i)
+			}
+		}
+		if r.push([]byte{0}) || r.len() != r.cap() {
+			t.Fatalf("expected full ring to reject a record, len = %v", r.len())
+		}
+		for i := 0; i < r.cap(); i++ {
+			var popped []byte
+			if !r.pop(func(record []byte) { popped = append(popped, record...) }) || len(popped) != 1 || popped[0] != byte(i) {
+				t.Fatalf("expected record %v actual = %v", i, popped)
+			}
+		}
+		if r.pop(nil) || r.len() != 0 {
+			t.Fatal("expected empty ring")
+		}
+	}
+}
+
+//gatedWriter blocks writes until its gate is closed
+type gatedWriter struct {
+	countingWriter
+	gate chan struct{}
+}
+
+func (g *gatedWriter) Write(b []byte) (int, error) {
+	<-g.gate
+	return g.countingWriter.Write(b)
+}
+
+//TestOutputStage fails if the overflow policy isn't applied while the queue is full, or if queued records are lost on stop
+func TestOutputStage(t *testing.T) {
+	tests := []struct {
+		Overflow string
+		//Expected are the records written once the output is unblocked
+		Expected string
+		Dropped  uint64
+	}{
+		//the writer holds record 0 in its buffer while its flush is blocked, records 1-4 fill the queue
+		{Overflow: OverflowDropNewest, Expected: "0\n1\n2\n3\n4\n", Dropped: 3},
+		{Overflow: OverflowDropOldest, Expected: "0\n4\n5\n6\n7\n", Dropped: 3},
+		{Overflow: OverflowBlock, Expected: "0\n1\n2\n3\n4\n5\n6\n7\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.Overflow, func(t *testing.T) {
+			out := &gatedWriter{gate: make(chan struct{})}
+			o := newOutputStage(newRecordWriter(out, ""), 4, test.Overflow, 0, nil)
+			go o.run()
+			o.Write([]byte("0\n"))
+			//wait until the writer is blocked flushing record 0
+			for deadline := time.Now().Add(time.Second); o.stats().Written != 1; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("timed out waiting for the writer")
+				}
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 1; i < 8; i++ {
+					o.Write([]byte{byte('0' + i), '\n'})
+				}
+			}()
+			if test.Overflow == OverflowBlock {
+				select {
+				case <-done:
+					t.Fatal("expected writes to block while the queue is full")
+				case <-time.After(50 * time.Millisecond):
+				}
+				if depth := o.stats().QueueDepth; depth != 4 {
+					t.Fatalf("expected a full queue actual = %v", depth)
+				}
+			}
+			close(out.gate)
+			<-done
+			o.stop()
+			stats := o.stats()
+			if out.String() != test.Expected || stats.Dropped != test.Dropped || stats.Pushed != 8 || stats.QueueDepth != 0 {
+				t.Fatalf("expected %q with %v dropped actual = %q %+v", test.Expected, test.Dropped, out.String(), stats)
+			}
+		})
+	}
+}
+
+//TestOutputStageConcurrent fails if records pushed by concurrent connections are lost, interleaved or allocate
+func TestOutputStageConcurrent(t *testing.T) {
+	const (
+		writers = 16
+		records = 2000
+		record  = "1257894000000000000,490154203237518,67.77,2.63555,33.41,44.4,0.25666\n"
+	)
+	out := &countingWriter{}
+	o := newOutputStage(newRecordWriter(out, ""), 64, OverflowBlock, time.Millisecond, nil)
+	go o.run()
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				o.Write([]byte(record))
+			}
+		}()
+	}
+	wg.Wait()
+	if allocs := testing.AllocsPerRun(1000, func() { o.Write([]byte(record)) }); allocs != 0 {
+		t.Fatalf("expected queueing a record not to allocate actual = %v allocs", allocs)
+	}
+	o.stop()
+	if out.String() != strings.Repeat(record, writers*records+1001) {
+		t.Fatalf("expected every record to be written whole, written = %v bytes", out.Len())
+	}
+}
+
+//benchRecord is a typical csv reading record
+var benchRecord = []byte("1257894000000000000,490154203237518,67.77,2.63555,33.41,44.4,0.25666\n")
+
+//go test -bench='OutputStage|RecordWriter' -benchmem -cpu 1,4 ./internal/server (measured on a single cpu host, so -cpu 4
+//only adds goroutine contention, not parallelism, and the record writer's lock is never contended. With 100 producers
+//saturating the queue, drop-newest drops most records & drop-oldest mostly pops & pushes against the other producers)
+//BenchmarkOutputStage/overflow=block           11667004                99.23 ns/op            0 B/op          0 allocs/op
+//BenchmarkOutputStage/overflow=block-4          3137774               414.6 ns/op             0 B/op          0 allocs/op
+//BenchmarkOutputStage/overflow=drop-newest     54347926                21.35 ns/op            0 B/op          0 allocs/op
+//BenchmarkOutputStage/overflow=drop-newest-4   49319608                21.47 ns/op            0 B/op          0 allocs/op
+//BenchmarkOutputStage/overflow=drop-oldest      1000000              2063 ns/op               1 B/op          0 allocs/op
+//BenchmarkOutputStage/overflow=drop-oldest-4    2038573              8665 ns/op               0 B/op          0 allocs/op
+//BenchmarkRecordWriter                         40699333                49.43 ns/op            0 B/op          0 allocs/op
+//BenchmarkRecordWriter-4                       31327412                54.00 ns/op            0 B/op          0 allocs/op
+func BenchmarkOutputStage(b *testing.B) {
+	for _, overflow := range []string{OverflowBlock, OverflowDropNewest, OverflowDropOldest} {
+		b.Run(fmt.Sprintf("overflow=%s", overflow), func(b *testing.B) {
+			o := newOutputStage(newRecordWriter(ioutil.Discard, ""), 8192, overflow, 100*time.Millisecond, nil)
+			go o.run()
+			defer o.stop()
+			b.ReportAllocs()
+			b.SetParallelism(100)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					o.Write(benchRecord)
+				}
+			})
+		})
+	}
+}
+
+//BenchmarkRecordWriter writes records straight to the output's lock, as connections did before the output stage
+func BenchmarkRecordWriter(b *testing.B) {
+	w := newRecordWriter(ioutil.Discard, "")
+	b.ReportAllocs()
+	b.SetParallelism(100)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w.Write(benchRecord)
+		}
+	})
+}
+
+// BenchmarkOutputStageRate pushes b.N records from 1000 connections at a combined 100k records/second, the way a large
+// fleet would, and logs how deep the queue got & how many records were dropped
+// BenchmarkOutputStageRate                         99770             10885 ns/op               3 B/op          0 allocs/op
+//
+//	output_test.go:289: 99770 records: max queue depth 845 of 8192, 0 dropped
+//
+// BenchmarkOutputStageRate-4                       97605             10874 ns/op               3 B/op          0 allocs/op
+//
+//	output_test.go:289: 97605 records: max queue depth 567 of 8192, 0 dropped
+func BenchmarkOutputStageRate(b *testing.B) {
+	const (
+		connections = 1000
+		rate        = 100000
+	)
+	o := newOutputStage(newRecordWriter(ioutil.Discard, ""), 8192, OverflowDropNewest, 100*time.Millisecond, nil)
+	go o.run()
+	var (
+		wg       sync.WaitGroup
+		maxDepth int64
+		stopped  = make(chan struct{})
+	)
+	go func() {
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-time.After(time.Millisecond):
+				if depth := int64(o.stats().QueueDepth); depth > atomic.LoadInt64(&maxDepth) {
+					atomic.StoreInt64(&maxDepth, depth)
+				}
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			//each connection sends every connections/rate seconds, starting at a different offset
+			interval := time.Second * connections / rate
+			time.Sleep(interval * time.Duration(i) / connections)
+			for n := i; n < b.N; n += connections {
+				o.Write(benchRecord)
+				time.Sleep(interval)
+			}
+		}(i)
+	}
+	wg.Wait()
+	b.StopTimer()
+	close(stopped)
+	o.stop()
+	stats := o.stats()
+	b.Logf("%v records: max queue depth %v of %v, %v dropped", stats.Pushed, atomic.LoadInt64(&maxDepth), stats.QueueCapacity, stats.Dropped)
+}
+
+//signalWriter signals every write
+type signalWriter struct {
+	written chan struct{}
+}
+
+func (s *signalWriter) Write(b []byte) (int, error) {
+	s.written <- struct{}{}
+	return len(b), nil
+}
+
+//TestIngestAllocs fails if a reading allocates on its way from a device's socket through the client, the registry &
+//the output stage to the reading output, in either ingest mode
+func TestIngestAllocs(t *testing.T) {
+	for _, mode := range []string{IngestGoroutine, IngestEpoll} {
+		t.Run(mode, func(t *testing.T) {
+			config := DefaultConfig()
+			config.TcpAddr, config.TcpPort = "127.0.0.1", 0
+			config.HttpAddr, config.HttpPort = "127.0.0.1", 0
+			config.IngestMode = mode
+			//records are flushed as soon as they're drained, so each reading is a write to the reading output
+			config.ReadingFlushInterval = 0
+			output := &signalWriter{written: make(chan struct{}, 1)}
+			s := newServer(config, log.New(ioutil.Discard, "", 0), log.New(output, "", 0))
+			if err := s.Start(context.Background()); err != nil {
+				t.Skipf("%s ingest mode unsupported: %s", mode, err)
+			}
+			defer s.Stop(context.Background())
+			device, err := net.Dial("tcp", s.Addr().Device.String())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer device.Close()
+			reading := benchReading.AppendBinary(nil)
+			//log in & warm up the connection's buffers
+			if _, err := device.Write(append([]byte("450154603277518"), reading...)); err != nil {
+				t.Fatal(err.Error())
+			}
+			<-output.written
+			allocs := testing.AllocsPerRun(1000, func() {
+				if _, err := device.Write(reading); err != nil {
+					t.Fatal(err.Error())
+				}
+				<-output.written
+			})
+			if allocs > 0 {
+				t.Fatalf("expected a reading not to allocate actual = %v allocs", allocs)
+			}
+			if _, ok := s.devices.getReading(450154603277518); !ok {
+				t.Fatal("expected the device's reading to be set")
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"github.com/autom8ter/thermomatic/internal/common"
+	"sort"
+	"sync"
+	"time"
+)
+
+//quarantine holds devices that may not log in until their cooldown expires. Expired entries are removed lazily
+type quarantine struct {
+	mu       sync.Mutex
+	cooldown time.Duration
+	devices  map[uint64]common.QuarantineEntry
+}
+
+func newQuarantine(cooldown time.Duration) *quarantine {
+	return &quarantine{
+		cooldown: cooldown,
+		devices:  map[uint64]common.QuarantineEntry{},
+	}
+}
+
+//add quarantines imei for the cooldown. It reports false if quarantine is disabled
+func (q *quarantine) add(imei uint64, reason string, now time.Time) (common.QuarantineEntry, bool) {
+	if q.cooldown <= 0 {
+		return common.QuarantineEntry{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry := common.QuarantineEntry{IMEI: imei, Reason: reason, Since: now, Until: now.Add(q.cooldown)}
+	q.devices[imei] = entry
+	return entry, true
+}
+
+//get returns the quarantine entry of imei if it hasn't expired
+func (q *quarantine) get(imei uint64, now time.Time) (common.QuarantineEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.devices[imei]
+	if ok && !now.Before(entry.Until) {
+		delete(q.devices, imei)
+		return common.QuarantineEntry{}, false
+	}
+	return entry, ok
+}
+
+//list returns every unexpired quarantine entry, ordered by imei
+func (q *quarantine) list(now time.Time) []common.QuarantineEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]common.QuarantineEntry, 0, len(q.devices))
+	for imei, entry := range q.devices {
+		if !now.Before(entry.Until) {
+			delete(q.devices, imei)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].IMEI < entries[j].IMEI })
+	return entries
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"github.com/autom8ter/thermomatic/internal/client"
+	"sync"
+	"sync/atomic"
+)
+
+//registryShards is the number of independently locked shards in a registry. Must be a power of two
+const registryShards = 64
+
+//registry tracks every online device's sessions and latest reading. Devices are spread across shards by imei so
+//devices only contend with the other devices in their shard.
+type registry struct {
+	shards [registryShards]registryShard
+	//sessions is the number of sessions across all shards
+	sessions int64
+}
+
+type registryShard struct {
+	mu      sync.Mutex
+	devices map[uint64]*device
+	//pad keeps neighbouring shard locks off of the same cache line
+	_ [64]byte
+}
+
+//device is a registry entry
+type device struct {
+	sessions   []client.ClientConn
+	reading    client.Reading
+	hasReading bool
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i].devices = map[uint64]*device{}
+	}
+	return r
+}
+
+//shard returns the shard that owns imei. imei is hashed since its low digits(ex: the luhn checksum) aren't uniform
+func (r *registry) shard(imei uint64) *registryShard {
+	return &r.shards[(imei*0x9E3779B97F4A7C15)>>58&(registryShards-1)]
+}
+
+//add registers c as a session of its imei according to policy. If the device already has sessions they are returned
+//along with whether c was added: rejected logins return false, evicted sessions are removed from the registry.
+func (r *registry) add(c client.ClientConn, policy string) ([]client.ClientConn, bool) {
+	imei := c.GetIMEI()
+	shard := r.shard(imei)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	d, ok := shard.devices[imei]
+	if !ok {
+		d = &device{}
+		shard.devices[imei] = d
+	}
+	existing := d.sessions
+	if len(existing) > 0 {
+		switch policy {
+		case DuplicateLoginReject:
+			return existing, false
+		case DuplicateLoginEvict:
+			atomic.AddInt64(&r.sessions, -int64(len(existing)))
+			d.sessions = nil
+		case DuplicateLoginAllow:
+			existing = append([]client.ClientConn(nil), existing...)
+		}
+	}
+	d.sessions = append(d.sessions, c)
+	atomic.AddInt64(&r.sessions, 1)
+	return existing, true
+}
+
+//eachSession calls fn with every session. fn is called with the session's shard locked, so it must not call back into
+//the registry
+func (r *registry) eachSession(fn func(c client.ClientConn)) {
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.Lock()
+		for _, d := range shard.devices {
+			for _, c := range d.sessions {
+				fn(c)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+//latest returns the device's most recent session
+func (r *registry) latest(imei uint64) (client.ClientConn, bool) {
+	shard := r.shard(imei)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	d, ok := shard.devices[imei]
+	if !ok || len(d.sessions) == 0 {
+		return nil, false
+	}
+	return d.sessions[len(d.sessions)-1], true
+}
+
+//remove removes the session c. It reports whether c was removed & whether it was the last session of its imei
+func (r *registry) remove(c client.ClientConn) (removed, last bool) {
+	imei := c.GetIMEI()
+	shard := r.shard(imei)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	d, ok := shard.devices[imei]
+	if !ok {
+		return false, false
+	}
+	for i, session := range d.sessions {
+		if session != c {
+			continue
+		}
+		d.sessions = append(d.sessions[:i], d.sessions[i+1:]...)
+		atomic.AddInt64(&r.sessions, -1)
+		if len(d.sessions) > 0 {
+			return true, false
+		}
+		if !d.hasReading {
+			delete(shard.devices, imei)
+		}
+		return true, true
+	}
+	return false, false
+}
+
+//sessionsOf returns a copy of the device's sessions
+func (r *registry) sessionsOf(imei uint64) []client.ClientConn {
+	shard := r.shard(imei)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	d, ok := shard.devices[imei]
+	if !ok {
+		return nil
+	}
+	return append([]client.ClientConn(nil), d.sessions...)
+}
+
+//setReading stores a copy of the device's latest reading. A backfilled reading doesn't replace a more recent reading.
+//setReading doesn't allocate for registered devices
+func (r *registry) setReading(imei uint64, reading *client.Reading) {
+	shard := r.shard(imei)
+	shard.mu.Lock()
+	d, ok := shard.devices[imei]
+	if !ok {
+		d = &device{}
+		shard.devices[imei] = d
+	}
+	if reading.Backfilled && d.hasReading && d.reading.Timestamp.After(reading.Timestamp) {
+		shard.mu.Unlock()
+		return
+	}
+	d.reading = *reading
+	d.hasReading = true
+	shard.mu.Unlock()
+}
+
+//getReading returns a copy of the device's latest reading
+func (r *registry) getReading(imei uint64) (client.Reading, bool) {
+	shard := r.shard(imei)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	d, ok := shard.devices[imei]
+	if !ok || !d.hasReading {
+		return client.Reading{}, false
+	}
+	return d.reading, true
+}
+
+//deleteReading forgets the device's latest reading. Devices without sessions are removed from the registry
+func (r *registry) deleteReading(imei uint64) {
+	shard := r.shard(imei)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	d, ok := shard.devices[imei]
+	if !ok {
+		return
+	}
+	d.reading = client.Reading{}
+	d.hasReading = false
+	if len(d.sessions) == 0 {
+		delete(shard.devices, imei)
+	}
+}
+
+//expireReading forgets the latest reading of a device that has no sessions
+func (r *registry) expireReading(imei uint64) {
+	shard := r.shard(imei)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if d, ok := shard.devices[imei]; ok && len(d.sessions) == 0 {
+		delete(shard.devices, imei)
+	}
+}
+
+//totalSessions returns the number of sessions across all devices
+func (r *registry) totalSessions() int {
+	return int(atomic.LoadInt64(&r.sessions))
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/client"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var benchReading = &client.Reading{
+	Temperature:  67.77,
+	Altitude:     2.63555,
+	Latitude:     33.41,
+	Longitude:    44.4,
+	BatteryLevel: 0.25666,
+}
+
+//newBenchRegistry returns a registry with n logged in devices and their imeis
+func newBenchRegistry(n int) (*registry, []uint64) {
+	r := newRegistry()
+	imeis := make([]uint64, n)
+	for i := range imeis {
+		imeis[i] = 450154603277518 + uint64(i)
+		r.add(&session{imei: imeis[i]}, DuplicateLoginEvict)
+	}
+	return r, imeis
+}
+
+//TestRegistrySetReading fails if storing a reading allocates or the stored reading isn't a copy
+func TestRegistrySetReading(t *testing.T) {
+	r, imeis := newBenchRegistry(1000)
+	apr := testing.AllocsPerRun(5000, func() {
+		r.setReading(imeis[500], benchReading)
+	})
+	if apr > 0 {
+		t.Fatalf("allocations per run is greater than zero! %v", apr)
+	}
+	reading := *benchReading
+	r.setReading(imeis[0], &reading)
+	reading.Temperature = 0
+	stored, ok := r.getReading(imeis[0])
+	if !ok || stored.Temperature != benchReading.Temperature {
+		t.Fatalf("expected stored reading to be a copy actual = %v", stored)
+	}
+	r.deleteReading(imeis[0])
+	if _, ok := r.getReading(imeis[0]); ok {
+		t.Fatal("expected reading to be deleted")
+	}
+}
+
+//TestRegistrySetBackfilledReading fails if a backfilled reading replaces a more recent reading
+func TestRegistrySetBackfilledReading(t *testing.T) {
+	r, imeis := newBenchRegistry(1)
+	now := time.Now()
+	backfilled := client.Reading{Temperature: 1, Timestamp: now.Add(-time.Minute), Backfilled: true}
+	r.setReading(imeis[0], &backfilled)
+	if stored, _ := r.getReading(imeis[0]); !stored.Backfilled {
+		t.Fatalf("expected backfilled reading to be stored actual = %+v", stored)
+	}
+	live := client.Reading{Temperature: 2, Timestamp: now}
+	r.setReading(imeis[0], &live)
+	r.setReading(imeis[0], &backfilled)
+	if stored, _ := r.getReading(imeis[0]); stored.Backfilled || stored.Temperature != live.Temperature {
+		t.Fatalf("expected live reading to be kept actual = %+v", stored)
+	}
+}
+
+//mutexMaps is the pair of single mutex maps registry replaced, kept as the baseline of its benchmarks. Duplicate logins
+//evict the device's sessions
+type mutexMaps struct {
+	clientMu  sync.Mutex
+	clients   map[uint64][]client.ClientConn
+	readingMu sync.Mutex
+	readings  map[uint64]*client.Reading
+}
+
+func (m *mutexMaps) add(c client.ClientConn) {
+	m.clientMu.Lock()
+	m.clients[c.GetIMEI()] = []client.ClientConn{c}
+	m.clientMu.Unlock()
+}
+
+func (m *mutexMaps) remove(c client.ClientConn) bool {
+	imei := c.GetIMEI()
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	sessions := m.clients[imei]
+	for i, session := range sessions {
+		if session != c {
+			continue
+		}
+		sessions = append(sessions[:i], sessions[i+1:]...)
+		if len(sessions) == 0 {
+			delete(m.clients, imei)
+			return true
+		}
+		m.clients[imei] = sessions
+		return false
+	}
+	return false
+}
+
+func (m *mutexMaps) setReading(imei uint64, reading *client.Reading) {
+	m.readingMu.Lock()
+	defer m.readingMu.Unlock()
+	m.readings[imei] = reading
+}
+
+func (m *mutexMaps) getReading(imei uint64) (*client.Reading, bool) {
+	m.readingMu.Lock()
+	defer m.readingMu.Unlock()
+	reading, ok := m.readings[imei]
+	return reading, ok
+}
+
+//deviceOps are the operations benchmarkDevices runs on a device
+type deviceOps struct {
+	set, get, reconnect func(device int)
+}
+
+//benchmarkDevices runs ops from parallel goroutines over every device, the way devices sending readings are spread
+//across connection goroutines. Every op stores a reading, every 64th op also reads one back(ex: GET /readings) and
+//every 1024th op reconnects the device
+func benchmarkDevices(b *testing.B, newOps func(sessions []client.ClientConn) deviceOps) {
+	for _, devices := range []int{10000, 100000} {
+		b.Run(fmt.Sprintf("devices=%v", devices), func(b *testing.B) {
+			sessions := make([]client.ClientConn, devices)
+			for i := range sessions {
+				sessions[i] = &session{imei: 450154603277518 + uint64(i)}
+			}
+			ops := newOps(sessions)
+			var next uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := atomic.AddUint64(&next, 7919)
+				for pb.Next() {
+					i++
+					device := int(i % uint64(devices))
+					ops.set(device)
+					if i%64 == 0 {
+						ops.get(device)
+					}
+					if i%1024 == 0 {
+						ops.reconnect(device)
+					}
+				}
+			})
+		})
+	}
+}
+
+//go test -run xxx -bench 'Registry$|MutexMaps' -benchmem -cpu 1,4,16 ./internal/server
+//
+//measured on a 1 cpu host, so the -4 & -16 runs interleave goroutines on one core instead of running them in parallel
+//and no lock is ever contended by another core. Most of the registry's lead is the allocation of every reading the
+//mutex maps need, as the client did to store it by pointer. The mutex maps also slow down more as goroutines share the
+//core(172 to 233 ns/op at 10000 devices, against 43 to 49): one preempted while holding their reading lock stalls every
+//device, one preempted inside a shard only stalls that shard's devices. Contention across cores isn't measured here
+//BenchmarkRegistry/devices=10000                28570357        42.66 ns/op          0 B/op          0 allocs/op
+//BenchmarkRegistry/devices=10000-4              28527988        43.50 ns/op          0 B/op          0 allocs/op
+//BenchmarkRegistry/devices=10000-16             23158675        49.35 ns/op          0 B/op          0 allocs/op
+//BenchmarkRegistry/devices=100000                9196566        114.9 ns/op          0 B/op          0 allocs/op
+//BenchmarkRegistry/devices=100000-4             14679514        75.87 ns/op          0 B/op          0 allocs/op
+//BenchmarkRegistry/devices=100000-16            13718742        105.2 ns/op          0 B/op          0 allocs/op
+//BenchmarkMutexMaps/devices=10000                6617270        172.2 ns/op        112 B/op          1 allocs/op
+//BenchmarkMutexMaps/devices=10000-4              5880048        200.8 ns/op        112 B/op          1 allocs/op
+//BenchmarkMutexMaps/devices=10000-16             4929190        232.8 ns/op        112 B/op          1 allocs/op
+//BenchmarkMutexMaps/devices=100000               4911705        204.5 ns/op        112 B/op          1 allocs/op
+//BenchmarkMutexMaps/devices=100000-4             5606211        218.1 ns/op        112 B/op          1 allocs/op
+//BenchmarkMutexMaps/devices=100000-16            4636693        230.8 ns/op        112 B/op          1 allocs/op
+func BenchmarkRegistry(b *testing.B) {
+	benchmarkDevices(b, func(sessions []client.ClientConn) deviceOps {
+		r := newRegistry()
+		for _, c := range sessions {
+			r.add(c, DuplicateLoginEvict)
+			r.setReading(c.GetIMEI(), benchReading)
+		}
+		return deviceOps{
+			set: func(device int) { r.setReading(sessions[device].GetIMEI(), benchReading) },
+			get: func(device int) { r.getReading(sessions[device].GetIMEI()) },
+			reconnect: func(device int) {
+				r.remove(sessions[device])
+				r.add(sessions[device], DuplicateLoginEvict)
+			},
+		}
+	})
+}
+
+//BenchmarkMutexMaps runs the registry's benchmark against the mutex maps it replaced. Each reading is allocated since
+//the maps keep the pointer they're given
+func BenchmarkMutexMaps(b *testing.B) {
+	benchmarkDevices(b, func(sessions []client.ClientConn) deviceOps {
+		m := &mutexMaps{clients: map[uint64][]client.ClientConn{}, readings: map[uint64]*client.Reading{}}
+		for _, c := range sessions {
+			m.add(c)
+			m.setReading(c.GetIMEI(), benchReading)
+		}
+		return deviceOps{
+			set: func(device int) {
+				reading := new(client.Reading)
+				*reading = *benchReading
+				m.setReading(sessions[device].GetIMEI(), reading)
+			},
+			get: func(device int) { m.getReading(sessions[device].GetIMEI()) },
+			reconnect: func(device int) {
+				m.remove(sessions[device])
+				m.add(sessions[device])
+			},
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"sync/atomic"
+)
+
+//cacheLinePad keeps the ring's producer & consumer positions on separate cache lines
+type cacheLinePad [64]byte
+
+//ringSlot holds a record. seq tells producers & consumers whose turn it is to use the slot
+type ringSlot struct {
+	seq    uint64
+	record []byte
+	_      [64 - 8 - 24]byte
+}
+
+//ring is a bounded lock-free queue of records that is safe for any number of producers & consumers. Each slot's
+//record buffer is reused, so pushing & popping don't allocate once a slot has grown to fit the largest record.
+type ring struct {
+	slots []ringSlot
+	mask  uint64
+	_     cacheLinePad
+	//head is the position of the next push
+	head uint64
+	_    cacheLinePad
+	//tail is the position of the next pop
+	tail uint64
+	_    cacheLinePad
+}
+
+//newRing returns a ring that holds at least size records. The size is rounded up to a power of 2
+func newRing(size int) *ring {
+	capacity := 1
+	for capacity < size {
+		capacity <<= 1
+	}
+	r := &ring{
+		slots: make([]ringSlot, capacity),
+		mask:  uint64(capacity - 1),
+	}
+	for i := range r.slots {
+		r.slots[i].seq = uint64(i)
+		r.slots[i].record = make([]byte, 0, 128)
+	}
+	return r
+}
+
+//push copies record into the ring. It returns false if the ring is full
+func (r *ring) push(record []byte) bool {
+	for {
+		pos := atomic.LoadUint64(&r.head)
+		slot := &r.slots[pos&r.mask]
+		switch seq := atomic.LoadUint64(&slot.seq); {
+		case seq == pos:
+			//the slot is free, claim it
+			if atomic.CompareAndSwapUint64(&r.head, pos, pos+1) {
+				slot.record = append(slot.record[:0], record...)
+				atomic.StoreUint64(&slot.seq, pos+1)
+				return true
+			}
+		case seq < pos:
+			//the slot still holds the record pushed a lap ago
+			return false
+		}
+		//another producer claimed the slot first
+	}
+}
+
+//pop passes the oldest record to fn & removes it from the ring. The record is only valid until fn returns. It returns
+//false if the ring is empty
+func (r *ring) pop(fn func(record []byte)) bool {
+	for {
+		pos := atomic.LoadUint64(&r.tail)
+		slot := &r.slots[pos&r.mask]
+		switch seq := atomic.LoadUint64(&slot.seq); {
+		case seq == pos+1:
+			//the slot holds a record, claim it
+			if atomic.CompareAndSwapUint64(&r.tail, pos, pos+1) {
+				if fn != nil {
+					fn(slot.record)
+				}
+				atomic.StoreUint64(&slot.seq, pos+r.mask+1)
+				return true
+			}
+		case seq < pos+1:
+			//the slot is empty or its record is still being copied
+			return false
+		}
+		//another consumer claimed the slot first
+	}
+}
+
+//len returns the number of records in the ring
+func (r *ring) len() int {
+	tail := atomic.LoadUint64(&r.tail)
+	head := atomic.LoadUint64(&r.head)
+	if head < tail {
+		return 0
+	}
+	return int(head - tail)
+}
+
+//cap returns the number of records the ring holds
+func (r *ring) cap() int {
+	return len(r.slots)
+}
@@ -2,166 +2,549 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/autom8ter/thermomatic/internal/client"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 )
 
-//Config holds the configuration requirements to start the server
-type Config struct {
-	TcpPort         int
-	HttpPort        int
-	ClientLogPrefix string
-	ServerLogPrefix string
-}
-
 //server serves tcp connections for logging iot device readings and serves http endpoints for iot reading statistics/analysis
 type server struct {
-	tcpLis    *net.TCPListener
-	httpPort  string
-	mux       *http.ServeMux
-	serverLog *log.Logger
-	clientLog *log.Logger
-	wg        *sync.WaitGroup
-	clientMu  *sync.Mutex
-	clients   map[uint64]client.ClientConn
-	readings  map[uint64]*client.Reading
-	readingMu *sync.Mutex
-}
-
-//NewServer creates a new server instance from the given config
-func NewServer(config *Config) (Server, error) {
-	serverLog := log.New(os.Stdin, config.ServerLogPrefix, log.LstdFlags)
-	clientLog := log.New(os.Stderr, config.ClientLogPrefix, log.LstdFlags)
-	tcpLis, err := net.ListenTCP("tcp", &net.TCPAddr{
-		Port: config.TcpPort,
-	})
+	config *Config
+	//listeners accept device connections, starting with the default TcpAddr:TcpPort listener. Listeners are bound by
+	//Start unless they're supplied as options, as is httpLis
+	listeners  []*deviceListener
+	httpLis    net.Listener
+	httpServer *http.Server
+	mux        *http.ServeMux
+	serverLog  *log.Logger
+	clientLog  *log.Logger
+	//output queues reading records & writes them to the reading output
+	output *outputStage
+	//outputs are the files opened for logging, closed on shutdown or once the server fails to start
+	outputs []io.Closer
+	//wg tracks every client goroutine
+	wg *sync.WaitGroup
+	//loops tracks the accept loops & the http server goroutine
+	loops *sync.WaitGroup
+	//cancel cancels the context of every client connection
+	cancel    context.CancelFunc
+	startOnce *sync.Once
+	stopOnce  *sync.Once
+	//devices holds every logged in session and the latest reading of each imei
+	devices *registry
+	//limits bounds the number of device connections
+	limits *limits
+	//rejected counts rejected connections by reason
+	rejected *counters
+	//duplicates counts duplicate logins by outcome
+	duplicates *counters
+	//states counts device connections by state
+	states *stateGauges
+	//disconnects counts closed device connections by reason
+	disconnects *counters
+	//fleet keeps the metrics of closed device connections
+	fleet *fleet
+	//quarantined holds devices that may not log in after being disconnected for invalid readings
+	quarantined *quarantine
+	//commands queues commands for devices when the command channel is enabled
+	commands *commands
+	//deliveries tracks the goroutines delivering commands
+	deliveries *deliveries
+	//known holds the last known record of every device that has logged in
+	known *lastKnown
+	//expiries forget the cached readings of offline devices once their grace window passes
+	expiries *expiries
+	//poller serves device connections in epoll ingest mode
+	poller *client.Poller
+}
+
+//NewServer creates a new server instance from the given config. The config is validated, but nothing is bound until
+//the server is started.
+func NewServer(config *Config, opts ...Option) (Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	var outputs []io.Closer
+	serverOut, err := openOutput(config.LogOutput, &outputs)
+	if err != nil {
+		return nil, err
+	}
+	clientOut, err := openOutput(config.ReadingOutput, &outputs)
 	if err != nil {
+		closeAll(outputs)
 		return nil, err
 	}
-	return &server{
-		tcpLis:    tcpLis,
-		httpPort:  fmt.Sprintf(":%v", config.HttpPort),
-		mux:       http.NewServeMux(),
-		serverLog: serverLog,
-		clientLog: clientLog,
-		clientMu:  &sync.Mutex{},
-		wg:        &sync.WaitGroup{},
-		clients:   map[uint64]client.ClientConn{},
-		readingMu: &sync.Mutex{},
-		readings:  map[uint64]*client.Reading{},
-	}, nil
-}
-
-// Listen starts the tcp and http server
-func (s server) Listen(ctx context.Context) {
+	serverLog := log.New(serverOut, config.ServerLogPrefix, log.LstdFlags)
+	clientLog := log.New(clientOut, config.ClientLogPrefix, log.LstdFlags)
+	s := newServer(config, serverLog, clientLog)
+	s.outputs = outputs
+	if config.LastKnownFile != "" {
+		if err := s.known.load(config.LastKnownFile); err != nil {
+			closeAll(outputs)
+			return nil, err
+		}
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+//newServer creates a server that logs to the given loggers without binding any listeners. The config must be valid(see
+//Config.Validate)
+func newServer(config *Config, serverLog, clientLog *log.Logger) *server {
+	s := &server{
+		config:      config,
+		mux:         http.NewServeMux(),
+		serverLog:   serverLog,
+		clientLog:   clientLog,
+		wg:          &sync.WaitGroup{},
+		loops:       &sync.WaitGroup{},
+		startOnce:   &sync.Once{},
+		stopOnce:    &sync.Once{},
+		listeners:   deviceListeners(config),
+		devices:     newRegistry(),
+		limits:      newLimits(config),
+		rejected:    newCounters(),
+		duplicates:  newCounters(),
+		states:      &stateGauges{},
+		disconnects: newCounters(),
+		fleet:       &fleet{},
+		quarantined: newQuarantine(time.Duration(config.QuarantineCooldown)),
+		commands:    newCommands(),
+		deliveries:  &deliveries{},
+		known:       newLastKnown(time.Duration(config.SessionGrace), time.Duration(config.LastKnownRetention)),
+		expiries:    newExpiries(),
+	}
+	s.output = newOutputStage(
+		newRecordWriter(clientLog.Writer(), clientLog.Prefix()),
+		config.OutputQueueSize,
+		config.OutputOverflow,
+		time.Duration(config.ReadingFlushInterval),
+		func(err error) { serverLog.Printf("[ERROR] failed to write reading output: %s", err.Error()) },
+	)
+	return s
+}
+
+//openOutput returns stdout, stderr or the file at the given path opened for appending. Opened files are added to closers
+func openOutput(name string, closers *[]io.Closer) (io.Writer, error) {
+	switch name {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open output: %s", err)
+	}
+	*closers = append(*closers, f)
+	return f, nil
+}
+
+//closeAll closes every closer, ignoring errors
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+//Listen starts the tcp and http server. It blocks until ctx is cancelled, after which the server is stopped(see Stop).
+//Listen only returns once every client goroutine has exited.
+func (s *server) Listen(ctx context.Context) {
+	if err := s.Start(ctx); err != nil {
+		log.Fatalf("[FATAL] %s", err.Error())
+	}
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.ShutdownTimeout))
+	defer cancel()
+	if err := s.Stop(shutdownCtx); err != nil {
+		s.serverLog.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+//Start binds the device & http listeners(unless they were supplied as options) and serves them in the background.
+//Start returns once both listeners are ready to accept connections. ctx only bounds binding the listeners, use Stop
+//to stop the server. A server that fails to start closes its listeners & outputs and can't be started again.
+func (s *server) Start(ctx context.Context) error {
+	err := errors.New("server already started")
+	s.startOnce.Do(func() {
+		if err = s.start(ctx); err != nil {
+			s.closeListeners()
+			closeAll(s.outputs)
+		}
+	})
+	return err
+}
+
+func (s *server) start(ctx context.Context) error {
+	var (
+		lc  net.ListenConfig
+		err error
+	)
+	if s.config.IngestMode == IngestEpoll {
+		if s.poller, err = client.NewPoller(s.config.PollWorkers); err != nil {
+			return err
+		}
+	}
+	for _, l := range s.listeners {
+		if err := l.listen(ctx); err != nil {
+			return err
+		}
+	}
+	if s.httpLis == nil {
+		if s.httpLis, err = lc.Listen(ctx, "tcp", net.JoinHostPort(s.config.HttpAddr, strconv.Itoa(s.config.HttpPort))); err != nil {
+			return err
+		}
+	}
 	s.setupRoutes()
-	defer s.tcpLis.Close()
-	wg := sync.WaitGroup{} //wg will opens several goroutines to start the tcp & http servers.
-	wg.Add(1)
+	s.httpServer = &http.Server{Handler: s.mux}
+	//client connections outlive the start context, they're closed by Stop
+	clientCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for _, l := range s.listeners {
+		s.loops.Add(1)
+		go func(l *deviceListener) {
+			defer s.loops.Done()
+			s.serverLog.Printf("starting %s device listener %s on %s!", l.config.Network, l.config.name(), l.lis.Addr())
+			s.acceptLoop(clientCtx, l)
+			s.serverLog.Printf("%s device listener stopped accepting connections", l.config.name())
+		}(l)
+	}
+	go s.output.run()
+	if s.config.LastKnownFile != "" || s.config.LastKnownRetention > 0 {
+		s.loops.Add(1)
+		go func() {
+			defer s.loops.Done()
+			s.maintainLastKnown(clientCtx)
+		}()
+	}
+	s.loops.Add(1)
 	go func() {
-		defer wg.Done()
-		s.serverLog.Println("starting tcp server!")
-		for {
-			select {
-			case <-ctx.Done():
-				break
-			default:
-				if err := s.tcpLis.SetDeadline(time.Now().Add(1 * time.Minute)); err != nil {
-					s.serverLog.Printf("[ERROR] failed to accept tcp connection: %s", err.Error())
-					continue
-				}
-				conn, err := s.tcpLis.Accept()
-				if err != nil {
-					s.serverLog.Printf("[ERROR] failed to accept tcp connection: %s", err.Error())
-					continue
-				}
-				clientConn, err := client.NewClient(conn, s)
-				if err != nil {
-					s.serverLog.Printf("[ERROR] failed to create client: %s", err.Error())
-					continue
-				}
-				s.wg.Add(1)
-				go func(conn client.ClientConn) {
-					defer s.wg.Done()
-					conn.Connect(ctx)
-				}(clientConn)
-			}
+		defer s.loops.Done()
+		s.serverLog.Printf("starting http server on %s!", s.httpLis.Addr())
+		if err := s.httpServer.Serve(s.httpLis); err != nil && err != http.ErrServerClosed {
+			s.serverLog.Printf("[ERROR] http server: %s", err.Error())
 		}
 	}()
+	return nil
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		s.serverLog.Println("starting http server!")
-		if err := http.ListenAndServe(s.httpPort, s.mux); err != nil {
-			log.Fatalf("[FATAL] %s", err.Error())
+//closeListeners closes the device & http listeners & the poller after a failed start
+func (s *server) closeListeners() {
+	for _, l := range s.listeners {
+		if l.lis != nil {
+			l.lis.Close()
 		}
-	}()
+	}
+	if s.httpLis != nil {
+		s.httpLis.Close()
+	}
+	if s.poller != nil {
+		s.poller.Close()
+	}
+}
+
+//Stop stops accepting devices, closes every open device connection, shuts down the http server and flushes any
+//buffered reading output. ctx bounds how long the http server may take to finish in-flight requests. Stop only
+//returns once every client goroutine has exited. Stopping a server that was never started closes its outputs.
+func (s *server) Stop(ctx context.Context) error {
+	s.startOnce.Do(func() {
+		//a server that was never started only holds its outputs. It can't be started once stopped
+		closeAll(s.outputs)
+	})
+	if s.cancel == nil {
+		return errors.New("server not started")
+	}
+	var err error
+	s.stopOnce.Do(func() {
+		err = s.stop(ctx)
+	})
+	return err
+}
+
+func (s *server) stop(ctx context.Context) error {
+	s.serverLog.Println("shutting down server!")
+	//commands queued from now on stay queued, deliveries in flight finish before the clients are waited on
+	s.deliveries.stop()
+	//cancelling the clients' context closes their connections, closing the listeners unblocks Accept
+	s.cancel()
+	for _, l := range s.listeners {
+		if err := l.lis.Close(); err != nil {
+			s.serverLog.Printf("[ERROR] failed to close %s device listener: %s", l.config.name(), err.Error())
+		}
+	}
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		err = fmt.Errorf("failed to shutdown http server: %s", err)
+	}
+	s.loops.Wait()
+	if s.poller != nil {
+		s.poller.Close()
+	}
 	//wait until all client connections are closed before exiting server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		s.wg.Wait()
-	}()
-	wg.Wait()
+	s.wg.Wait()
+	s.expiries.stop()
+	s.flush()
+	if s.config.LastKnownFile != "" {
+		if err := s.known.save(s.config.LastKnownFile); err != nil {
+			s.serverLog.Printf("[ERROR] %s", err.Error())
+		}
+	}
+	s.serverLog.Println("server shutdown complete")
+	closeAll(s.outputs)
+	return err
 }
 
-//AddClient adds a client connection to manage
-func (s server) AddClient(client client.ClientConn) {
-	s.clientMu.Lock()
-	defer s.clientMu.Unlock()
-	s.clients[client.GetIMEI()] = client
+//Addr returns the addresses the server is bound to. Addresses are nil until the server is started
+func (s *server) Addr() Addr {
+	var addr Addr
+	for _, l := range s.listeners {
+		if l.lis != nil {
+			addr.Devices = append(addr.Devices, l.lis.Addr())
+		}
+	}
+	if len(addr.Devices) > 0 {
+		addr.Device = addr.Devices[0]
+	}
+	if s.httpLis != nil {
+		addr.HTTP = s.httpLis.Addr()
+	}
+	return addr
 }
 
-//RemoveClient removes the client connection
-func (s server) RemoveClient(imei uint64) {
-	s.clientMu.Lock()
-	defer s.clientMu.Unlock()
-	if _, ok := s.clients[imei]; ok {
-		delete(s.clients, imei)
+//bounds of the delay between retries of transient accept failures
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+//transientAcceptErrors are the accept failures a listener recovers from: running out of file descriptors or memory,
+//or a connection aborted before it was accepted
+var transientAcceptErrors = []error{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED}
+
+//transientAccept reports whether the accept failure is worth retrying
+func transientAccept(err error) bool {
+	for _, target := range transientAcceptErrors {
+		if errors.Is(err, target) {
+			return true
+		}
 	}
+	return false
 }
 
-func (s server) TotalClients() int {
-	s.clientMu.Lock()
-	defer s.clientMu.Unlock()
-	return len(s.clients)
+//acceptLoop accepts tcp connections and serves each of them in its own goroutine until ctx is cancelled. Stop closes
+//the listener to unblock Accept, so no deadline is needed. Transient accept failures(ex: running out of file
+//descriptors) are retried with an increasing delay, any other failure stops the listener
+func (s *server) acceptLoop(ctx context.Context, l *deviceListener) {
+	var delay time.Duration
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		conn, err := l.lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				//a deadline set on a supplied listener only wakes the loop up
+				continue
+			}
+			if transientAccept(err) {
+				if delay *= 2; delay == 0 {
+					delay = minAcceptDelay
+				} else if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				s.serverLog.Printf("[WARN] failed to accept %s connection on %s: %s, retrying in %s", l.config.Network, l.config.name(), err.Error(), delay)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				continue
+			}
+			//the server keeps serving its other listeners, the failure is reported by /health & /stats
+			l.fail(err)
+			s.serverLog.Printf("[ERROR] %s device listener stopped: %s", l.config.name(), err.Error())
+			return
+		}
+		delay = 0
+		if err := l.tcp.apply(conn); err != nil {
+			s.serverLog.Printf("[WARN] failed to set socket options of %s connection from %s: %s", l.config.Network, conn.RemoteAddr(), err.Error())
+		}
+		if !s.admit(l, conn) {
+			conn.Close()
+			continue
+		}
+		clientConn, err := client.NewClient(conn, s, l.options...)
+		if err != nil {
+			s.serverLog.Printf("[ERROR] failed to create client: %s", err.Error())
+			s.release(l, conn)
+			conn.Close()
+			continue
+		}
+		if s.poller != nil {
+			if err := s.poller.Add(clientConn, func() { s.release(l, conn) }); err != nil {
+				s.serverLog.Printf("[ERROR] failed to poll client: %s", err.Error())
+				s.release(l, conn)
+				conn.Close()
+			}
+			continue
+		}
+		s.wg.Add(1)
+		go func(conn client.ClientConn) {
+			defer s.wg.Done()
+			defer s.release(l, conn.GetConn())
+			conn.Connect(ctx)
+		}(clientConn)
+	}
 }
 
-//client.Cache implementation
-func (c server) SetReading(imei uint64, reading *client.Reading) {
-	c.readingMu.Lock()
-	defer c.readingMu.Unlock()
-	c.readings[imei] = reading
+//admit reserves a slot for conn in both the server's & the listener's limits
+func (s *server) admit(l *deviceListener, conn net.Conn) bool {
+	reason, ok := s.limits.admit(conn)
+	if ok {
+		if reason, ok = l.limits.admit(conn); !ok {
+			s.limits.release(conn)
+		}
+	}
+	if !ok {
+		s.rejected.inc(reason)
+		l.rejected.inc(reason)
+		s.serverLog.Printf("[WARN] rejected connection from %s on %s: %s", conn.RemoteAddr(), l.config.name(), reason)
+	}
+	return ok
+}
+
+//release frees the slots held by conn
+func (s *server) release(l *deviceListener, conn net.Conn) {
+	l.limits.release(conn)
+	s.limits.release(conn)
 }
 
-func (c server) GetReading(imei uint64) (*client.Reading, bool) {
-	c.readingMu.Lock()
-	defer c.readingMu.Unlock()
-	if reading, ok := c.readings[imei]; ok {
-		return reading, true
+//flush writes every queued reading record to the reading output
+func (s *server) flush() {
+	s.output.stop()
+}
+
+//AddClient adds a client connection to manage. If the client's imei is already online, the config's duplicate login
+//policy decides whether the client is rejected, evicts the existing session(s) or is added as a separate session. The
+//counters of evicted sessions are added to the device's last known record right away. Quarantined devices are rejected until their cooldown expires.
+func (s *server) AddClient(c client.ClientConn) error {
+	imei := c.GetIMEI()
+	if entry, ok := s.quarantined.get(imei, time.Now()); ok {
+		s.rejected.inc("quarantined")
+		s.serverLog.Printf("[WARN] %v rejected login from %s: quarantined until %s", imei, c.GetConn().RemoteAddr(), entry.Until.Format(time.RFC3339))
+		return &client.CloseError{Reason: client.CloseBanned, Err: fmt.Errorf("%v is quarantined until %s", imei, entry.Until.Format(time.RFC3339))}
 	}
-	return nil, false
+	existing, ok := s.devices.add(c, s.config.DuplicateLoginPolicy)
+	if !ok {
+		s.duplicates.inc("rejected")
+		s.serverLog.Printf("[WARN] %v rejected login from %s: already online from %s", imei, c.GetConn().RemoteAddr(), existing[0].GetConn().RemoteAddr())
+		return fmt.Errorf("duplicate login: %v is already online", imei)
+	}
+	if len(existing) > 0 {
+		switch s.config.DuplicateLoginPolicy {
+		case DuplicateLoginEvict:
+			for _, e := range existing {
+				s.duplicates.inc("evicted")
+				s.serverLog.Printf("[INFO] %v evicted session from %s: duplicate login from %s", imei, e.GetConn().RemoteAddr(), c.GetConn().RemoteAddr())
+				e.Close(client.CloseEvicted)
+				s.known.evict(e)
+			}
+		case DuplicateLoginAllow:
+			s.duplicates.inc("allowed")
+			s.serverLog.Printf("[INFO] %v allowed duplicate login from %s: %v other session(s) online", imei, c.GetConn().RemoteAddr(), len(existing))
+		}
+	}
+	s.limits.loggedIn(c.GetConn())
+	for _, l := range s.listeners {
+		l.limits.loggedIn(c.GetConn())
+	}
+	if s.known.online(c, time.Now()) {
+		s.serverLog.Printf("[INFO] %v resumed session from %s", imei, c.GetConn().RemoteAddr())
+	} else {
+		s.serverLog.Printf("[INFO] %v logged in from %s", imei, c.GetConn().RemoteAddr())
+	}
+	if s.config.Commands {
+		//deliver commands queued while the device was offline once its login completes
+		s.deliveries.start(func() { s.deliver(imei) })
+	}
+	return nil
 }
 
-func (c server) DeleteReading(imei uint64) {
-	c.readingMu.Lock()
-	defer c.readingMu.Unlock()
-	if _, ok := c.readings[imei]; ok {
-		delete(c.readings, imei)
+//RemoveClient removes the client connection's session. It reports whether it was the last session of the client's imei.
+//The session's counters are added to the device's last known record, an evicted session's were added when it was
+//evicted so only those it gained since are. Once a device's last session is removed its reading stays cached for the
+//session grace window, so a device that reconnects within it continues its session
+func (s *server) RemoveClient(c client.ClientConn) bool {
+	imei := c.GetIMEI()
+	s.known.retire(c)
+	if _, last := s.devices.remove(c); !last {
+		return false
+	}
+	s.known.offline(imei, c.CloseReason(), time.Now())
+	if grace := time.Duration(s.config.SessionGrace); grace > 0 {
+		s.expiries.schedule(imei, grace, func() { s.expireReading(imei) })
+	} else {
+		s.devices.expireReading(imei)
 	}
+	return true
+}
+
+func (s *server) TotalClients() int {
+	return s.devices.totalSessions()
+}
+
+//client.Cache implementation
+func (s *server) SetReading(imei uint64, reading *client.Reading) {
+	s.devices.setReading(imei, reading)
+}
+
+func (s *server) GetReading(imei uint64) (client.Reading, bool) {
+	return s.devices.getReading(imei)
+}
+
+func (s *server) DeleteReading(imei uint64) {
+	s.devices.deleteReading(imei)
 }
 
-func (s server) GetClientLogger() client.Printer {
+func (s *server) GetClientLogger() client.Printer {
 	return s.clientLog
 }
 
-func (s server) GetServerLogger() client.Printer {
+func (s *server) GetServerLogger() client.Printer {
 	return s.serverLog
 }
+
+func (s *server) GetReadingOutput() io.Writer {
+	return s.output
+}
+
+//StateChanged updates the connection state gauges. Closed connections are counted by reason and their metrics are
+//added to the fleet's totals. Devices disconnected for invalid readings are quarantined
+func (s *server) StateChanged(c client.ClientConn, from, to client.State) {
+	s.states.transition(from, to)
+	if to != client.StateClosed {
+		return
+	}
+	reason := c.CloseReason()
+	s.disconnects.inc(reason.String())
+	s.fleet.retire(c.Metrics())
+	if reason == client.CloseInvalidReadings {
+		if entry, ok := s.quarantined.add(c.GetIMEI(), reason.String(), time.Now()); ok {
+			s.serverLog.Printf("[WARN] %v quarantined until %s: %s", entry.IMEI, entry.Until.Format(time.RFC3339), entry.Reason)
+		}
+	}
+}
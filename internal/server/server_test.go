@@ -0,0 +1,849 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/client"
+	"github.com/autom8ter/thermomatic/internal/common"
+	"github.com/autom8ter/thermomatic/internal/server"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//TestServerStartStop fails if a server started on injected ephemeral listeners doesn't serve devices & the http api,
+//or doesn't close device connections when it's stopped
+func TestServerStartStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	deviceLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	httpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := server.DefaultConfig()
+	config.LogOutput = filepath.Join(dir, "server.log")
+	config.ReadingOutput = filepath.Join(dir, "readings.log")
+	var middleware int64
+	count := func(next client.ReadingHandler) client.ReadingHandler {
+		return func(c client.ClientConn, reading *client.Reading) error {
+			atomic.AddInt64(&middleware, 1)
+			return next(c, reading)
+		}
+	}
+	s, err := server.NewServer(config,
+		server.WithDeviceListener(deviceLis),
+		server.WithHTTPListener(httpLis),
+		server.WithClientOptions(client.WithReadingMiddleware(count)),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("expected second start to fail")
+	}
+	addr := s.Addr()
+	if addr.Device.String() != deviceLis.Addr().String() || addr.HTTP.String() != httpLis.Addr().String() {
+		t.Fatalf("expected server to be bound to the injected listeners actual = %+v", addr)
+	}
+	device, err := net.Dial("tcp", addr.Device.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer device.Close()
+	reading := &client.Reading{
+		Temperature:  67.77,
+		Altitude:     2.63555,
+		Latitude:     33.41,
+		Longitude:    44.4,
+		BatteryLevel: 0.25666,
+	}
+	if _, err := device.Write([]byte("450154603277518")); err != nil {
+		t.Fatal(err.Error())
+	}
+	encoded, err := reading.Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := device.Write(encoded); err != nil {
+		t.Fatal(err.Error())
+	}
+	var latest client.Reading
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/readings?imei=450154603277518", addr.HTTP))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = json.NewDecoder(resp.Body).Decode(&latest)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for reading: %v", resp.Status)
+		}
+	}
+	//the timestamp is set when the reading is received
+	received := latest.Timestamp
+	latest.Timestamp = reading.Timestamp
+	if latest != *reading {
+		t.Fatalf("expected latest reading = %+v actual = %+v", *reading, latest)
+	}
+	if atomic.LoadInt64(&middleware) != 1 {
+		t.Fatal("expected client options to be applied to accepted clients")
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/stats", addr.HTTP))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var stats common.Stats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stats.Fleet.BytesRead != 55 || stats.Fleet.ValidReadings != 1 || stats.Fleet.MeanLoginLatencyMs <= 0 {
+		t.Fatalf("expected fleet metrics of the logged in device actual = %+v", stats.Fleet)
+	}
+	if stats.Output.Pushed != 1 || stats.Output.QueueCapacity != 8192 || stats.Output.Overflow != server.OverflowBlock {
+		t.Fatalf("expected output stats of the queued record actual = %+v", stats.Output)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	//the device connection is closed once Stop returns
+	device.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := device.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected device connection to be closed actual = %v", err)
+	}
+	if _, err := net.Dial("tcp", addr.Device.String()); err == nil {
+		t.Fatal("expected device listener to be closed")
+	}
+	//buffered records are flushed on shutdown
+	records, err := ioutil.ReadFile(config.ReadingOutput)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := fmt.Sprintf("%v,450154603277518,67.77,2.63555,33.41,44.4,0.25666\n", received.UnixNano()); string(records) != expected {
+		t.Fatalf("expected reading output %q actual = %q", expected, records)
+	}
+}
+
+//TestServerListeners fails if devices aren't served on every listener, or a listener's limits & stats aren't kept
+//separately from the others
+func TestServerListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	config := server.DefaultConfig()
+	config.TcpAddr, config.TcpPort = "127.0.0.1", 0
+	config.HttpAddr, config.HttpPort = "127.0.0.1", 0
+	config.LogOutput = filepath.Join(dir, "server.log")
+	config.ReadingOutput = filepath.Join(dir, "readings.log")
+	config.Listeners = []server.ListenerConfig{
+		{Name: "gateway", Network: "unix", Address: filepath.Join(dir, "thermomatic.sock")},
+		{Name: "limited", Network: "tcp", Address: "127.0.0.1:0", MaxConnections: 1},
+	}
+	s, err := server.NewServer(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Stop(context.Background())
+	addr := s.Addr()
+	if len(addr.Devices) != 3 || addr.Device != addr.Devices[0] {
+		t.Fatalf("expected 3 device listeners actual = %v", addr.Devices)
+	}
+	var devices []net.Conn
+	for i, imei := range []string{"450154603277518", "490154203237518", "356938035643809"} {
+		device, err := net.Dial(addr.Devices[i].Network(), addr.Devices[i].String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer device.Close()
+		if _, err := device.Write([]byte(imei)); err != nil {
+			t.Fatal(err.Error())
+		}
+		devices = append(devices, device)
+	}
+	//the limited listener only admits one connection
+	rejected, err := net.Dial("tcp", addr.Devices[2].String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rejected.Close()
+	var stats common.Stats
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/stats", addr.HTTP))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if stats.ClientConnections == 3 && stats.Listeners["limited"].Rejected["max_connections"] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for logins: %+v", stats)
+		}
+	}
+	for _, name := range []string{"default", "gateway", "limited"} {
+		if l := stats.Listeners[name]; l.Connections != 1 || l.PendingLogins != 0 {
+			t.Errorf("expected 1 logged in connection on %s actual = %+v", name, l)
+		}
+	}
+	if stats.States["active"] != 3 || stats.States["accepted"] != 0 {
+		t.Errorf("expected 3 active connections actual = %v", stats.States)
+	}
+	if stats.Connections != 3 || stats.Rejected["max_connections"] != 1 {
+		t.Errorf("expected 3 connections & 1 rejection across listeners actual = %+v", stats)
+	}
+}
+
+//TestServerQuarantine fails if a device disconnected for invalid readings isn't quarantined, or may log in again
+//before its cooldown expires
+func TestServerQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	config := server.DefaultConfig()
+	config.TcpAddr, config.TcpPort = "127.0.0.1", 0
+	config.HttpAddr, config.HttpPort = "127.0.0.1", 0
+	config.LogOutput = filepath.Join(dir, "server.log")
+	config.ReadingOutput = filepath.Join(dir, "readings.log")
+	config.MaxConsecutiveInvalid = 2
+	config.QuarantineCooldown = server.Duration(time.Minute)
+	s, err := server.NewServer(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Stop(context.Background())
+	addr := s.Addr()
+	const imei = "450154603277518"
+	invalid, err := (&client.Reading{Temperature: 500}).Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//login, then send invalid readings until the server hangs up
+	device, err := net.Dial("tcp", addr.Device.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer device.Close()
+	message := append([]byte(imei), invalid...)
+	if _, err := device.Write(append(message, invalid...)); err != nil {
+		t.Fatal(err.Error())
+	}
+	device.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := device.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected device to be disconnected actual = %v", err)
+	}
+	var entry common.QuarantineEntry
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/quarantine?imei=%s", addr.HTTP, imei))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&entry)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for quarantine: %v", resp.Status)
+		}
+	}
+	if fmt.Sprint(entry.IMEI) != imei || entry.Reason != client.CloseInvalidReadings.String() || time.Until(entry.Until) <= 0 {
+		t.Fatalf("unexpected quarantine entry: %+v", entry)
+	}
+	//the quarantined device may not log in again
+	device, err = net.Dial("tcp", addr.Device.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer device.Close()
+	if _, err := device.Write([]byte(imei)); err != nil {
+		t.Fatal(err.Error())
+	}
+	device.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := device.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected quarantined login to be rejected actual = %v", err)
+	}
+	var stats common.Stats
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/stats", addr.HTTP))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if stats.Disconnects[client.CloseBanned.String()] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the rejected login to close: %+v", stats)
+		}
+	}
+	if stats.Quarantined != 1 || stats.Rejected["quarantined"] != 1 {
+		t.Fatalf("expected 1 quarantined device & 1 rejected login actual = %+v", stats)
+	}
+	if fleet := stats.Fleet; fleet.RejectedFields["temperature"] != 2 || fleet.RejectedFields["batteryLevel"] != 2 || fleet.InvalidReadings["batteryLevel"] != 0 {
+		t.Fatalf("expected the invalid readings' fields to be counted actual = %+v", fleet)
+	}
+}
+
+//simulateDevice logs in as imei & acknowledges every command it receives, rejecting reboots as unsupported. It returns
+//once the connection is closed
+func simulateDevice(conn net.Conn, imei string) {
+	if _, err := conn.Write([]byte(imei)); err != nil {
+		return
+	}
+	frame := make([]byte, client.CommandFrameLength)
+	for {
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+		var cmd client.Command
+		if err := cmd.Decode(frame); err != nil {
+			return
+		}
+		ack := client.Ack{ID: cmd.ID, Status: client.AckOK}
+		if cmd.Type == client.CommandReboot {
+			ack.Status = client.AckUnsupported
+		}
+		if _, err := conn.Write(ack.Encode()); err != nil {
+			return
+		}
+	}
+}
+
+//TestServerCommands fails if commands queued over http aren't delivered to the device once it's online, or their
+//delivery status doesn't reflect the device's acknowledgements
+func TestServerCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	config := server.DefaultConfig()
+	config.TcpAddr, config.TcpPort = "127.0.0.1", 0
+	config.HttpAddr, config.HttpPort = "127.0.0.1", 0
+	config.LogOutput = filepath.Join(dir, "server.log")
+	config.ReadingOutput = filepath.Join(dir, "readings.log")
+	config.ReadTimeout = server.Duration(5 * time.Second)
+	config.Commands = true
+	s, err := server.NewServer(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Stop(context.Background())
+	addr := s.Addr()
+	const imei = "450154603277518"
+	commands := fmt.Sprintf("http://%s/devices/%s/commands", addr.HTTP, imei)
+	post := func(body string) common.CommandStatus {
+		resp, err := http.Post(commands, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected %v actual = %v", http.StatusAccepted, resp.Status)
+		}
+		var status common.CommandStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err.Error())
+		}
+		return status
+	}
+	//the device is offline so the command stays queued
+	interval := post(`{"type": "set_interval", "arg": 30}`)
+	if interval.Status != "queued" || interval.Type != "set_interval" || interval.Arg != 30 {
+		t.Fatalf("unexpected command status: %+v", interval)
+	}
+	invalid := []struct {
+		Name string
+		URL  string
+		Body string
+	}{
+		{Name: "unknown type", URL: commands, Body: `{"type": "self_destruct"}`},
+		{Name: "empty body", URL: commands, Body: `{}`},
+		{Name: "missing type", URL: commands, Body: `{"arg": 5}`},
+		{Name: "missing interval", URL: commands, Body: `{"type": "set_interval"}`},
+		{Name: "zero imei", URL: fmt.Sprintf("http://%s/devices/0/commands", addr.HTTP), Body: `{"type": "reboot"}`},
+		{Name: "invalid checksum", URL: fmt.Sprintf("http://%s/devices/450154603277519/commands", addr.HTTP), Body: `{"type": "reboot"}`},
+	}
+	for _, test := range invalid {
+		resp, err := http.Post(test.URL, "application/json", strings.NewReader(test.Body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected %s to be rejected actual = %v", test.Name, resp.Status)
+		}
+	}
+	device, err := net.Dial("tcp", addr.Device.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer device.Close()
+	go simulateDevice(device, imei)
+	reboot := post(`{"type": "reboot"}`)
+	want := map[uint32]string{interval.ID: "acknowledged", reboot.ID: "rejected"}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(commands)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var statuses []common.CommandStatus
+		err = json.NewDecoder(resp.Body).Decode(&statuses)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		done := len(statuses) == len(want)
+		for _, status := range statuses {
+			done = done && status.Status == want[status.ID]
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for acknowledgements: %+v", statuses)
+		}
+	}
+	resp, err := http.Get(fmt.Sprintf("%s/%v", commands, reboot.ID))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	var status common.CommandStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err.Error())
+	}
+	if status.Status != "rejected" || status.Error != "device responded: unsupported" {
+		t.Fatalf("unexpected reboot status: %+v", status)
+	}
+}
+
+//getJSON decodes the json response of a GET request into v if it succeeds, and returns the response status code
+func getJSON(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return resp.StatusCode
+}
+
+//TestServerSessionGrace fails if a device's reading & counters don't survive a reconnect within the session grace
+//window, if its reading isn't forgotten once the window passes, or if its last known record isn't persisted
+func TestServerSessionGrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	config := server.DefaultConfig()
+	config.TcpAddr, config.TcpPort = "127.0.0.1", 0
+	config.HttpAddr, config.HttpPort = "127.0.0.1", 0
+	config.LogOutput = filepath.Join(dir, "server.log")
+	config.ReadingOutput = filepath.Join(dir, "readings.log")
+	config.SessionGrace = server.Duration(500 * time.Millisecond)
+	config.LastKnownFile = filepath.Join(dir, "devices.json")
+	s, err := server.NewServer(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := s.Addr()
+	const imei = "450154603277518"
+	var (
+		record   common.DeviceRecord
+		reading  client.Reading
+		devices  = fmt.Sprintf("http://%s/devices/%s", addr.HTTP, imei)
+		readings = fmt.Sprintf("http://%s/readings?imei=%s", addr.HTTP, imei)
+	)
+	encoded, err := (&client.Reading{Temperature: 21, BatteryLevel: 50}).Encode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//waitRecord polls the device's record until cond is true
+	waitRecord := func(cond func() bool) {
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if getJSON(t, devices, &record) == http.StatusOK && cond() {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for device record: %+v", record)
+			}
+		}
+	}
+	//connect sends a reading & disconnects
+	connect := func() {
+		device, err := net.Dial("tcp", addr.Device.String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer device.Close()
+		if _, err := device.Write(append([]byte(imei), encoded...)); err != nil {
+			t.Fatal(err.Error())
+		}
+		waitRecord(func() bool { return record.Online && record.LastSeen.After(record.ConnectedAt) })
+	}
+	connect()
+	waitRecord(func() bool { return !record.Online })
+	if record.DisconnectReason != client.ClosePeerEOF.String() || record.ValidReadings != 1 {
+		t.Fatalf("unexpected record of offline device: %+v", record)
+	}
+	connectedAt := record.ConnectedAt
+	//the reading survives the disconnect & the session continues on reconnect
+	if status := getJSON(t, readings, &reading); status != http.StatusOK {
+		t.Fatalf("expected reading to be cached within the grace window actual = %v", status)
+	}
+	connect()
+	waitRecord(func() bool { return !record.Online })
+	if record.Reconnects != 1 || record.ValidReadings != 2 || !record.ConnectedAt.Equal(connectedAt) {
+		t.Fatalf("expected the session to continue after reconnecting: %+v", record)
+	}
+	//the reading is forgotten once the grace window passes, the record is kept
+	for deadline := time.Now().Add(2 * time.Second); getJSON(t, readings, &reading) == http.StatusOK; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected reading to be forgotten after the grace window")
+		}
+	}
+	if getJSON(t, devices, &record) != http.StatusOK || record.Online {
+		t.Fatalf("expected the last known record to be kept: %+v", record)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	//the record is loaded by the next server
+	s, err = server.NewServer(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Stop(context.Background())
+	var loaded common.DeviceRecord
+	if status := getJSON(t, fmt.Sprintf("http://%s/devices/%s", s.Addr().HTTP, imei), &loaded); status != http.StatusOK {
+		t.Fatalf("expected last known record to be loaded actual = %v", status)
+	}
+	if loaded.ValidReadings != 2 || loaded.DisconnectReason != client.ClosePeerEOF.String() || loaded.Online {
+		t.Fatalf("unexpected loaded record: %+v", loaded)
+	}
+}
+
+//acceptError is a net.Error returned by flakyListener. It claims to be temporary, which the accept loop ignores
+type acceptError struct {
+	timeout bool
+}
+
+func (e acceptError) Error() string   { return fmt.Sprintf("accept error(timeout: %v)", e.timeout) }
+func (e acceptError) Timeout() bool   { return e.timeout }
+func (e acceptError) Temporary() bool { return true }
+
+//acceptErrno returns the error Accept fails with for errno
+func acceptErrno(errno syscall.Errno) error {
+	return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", errno)}
+}
+
+//flakyListener fails its first Accept calls with the given errors before accepting connections
+type flakyListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+		return l.Listener.Accept()
+	}
+}
+
+//TestServerAccept fails if the accept loop doesn't silently ignore deadline wakeups, retry transient failures with a
+//warning, or apply the tcp socket options to accepted connections
+func TestServerAccept(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	flaky := &flakyListener{Listener: lis, errs: make(chan error, 3)}
+	flaky.errs <- acceptError{timeout: true}
+	flaky.errs <- acceptErrno(syscall.EMFILE)
+	flaky.errs <- acceptErrno(syscall.ECONNABORTED)
+	httpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := server.DefaultConfig()
+	config.LogOutput = filepath.Join(dir, "server.log")
+	config.ReadingOutput = filepath.Join(dir, "readings.log")
+	config.TCPReadBuffer = 64 << 10
+	s, err := server.NewServer(config, server.WithDeviceListener(flaky), server.WithHTTPListener(httpLis))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	device, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer device.Close()
+	if _, err := device.Write([]byte("450154603277518")); err != nil {
+		t.Fatal(err.Error())
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var record common.DeviceRecord
+		if getJSON(t, fmt.Sprintf("http://%s/devices/450154603277518", httpLis.Addr()), &record) == http.StatusOK && record.Online {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the device to log in")
+		}
+	}
+	var health common.Health
+	if status := getJSON(t, fmt.Sprintf("http://%s/health", httpLis.Addr()), &health); status != http.StatusOK || health.Status != "ok" {
+		t.Fatalf("expected a healthy server actual = %v %+v", status, health)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	logs, err := ioutil.ReadFile(config.LogOutput)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if retries := strings.Count(string(logs), "retrying in"); retries != 2 {
+		t.Fatalf("expected 2 retried accept failures actual = %v:\n%s", retries, logs)
+	}
+	if strings.Contains(string(logs), "timeout: true") || strings.Contains(string(logs), "[ERROR]") || strings.Contains(string(logs), "failed to set socket options") {
+		t.Fatalf("unexpected log lines:\n%s", logs)
+	}
+}
+
+//TestServerAcceptFailure fails if a device listener that stopped accepting connections isn't reported as failing,
+//while the server keeps serving its other listeners
+func TestServerAcceptFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	broken := &flakyListener{Listener: lis, errs: make(chan error, 1)}
+	broken.errs <- acceptError{}
+	httpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := server.DefaultConfig()
+	config.LogOutput = filepath.Join(dir, "server.log")
+	config.ReadingOutput = filepath.Join(dir, "readings.log")
+	config.Listeners = []server.ListenerConfig{{Name: "gateway", Network: "tcp", Address: "127.0.0.1:0"}}
+	s, err := server.NewServer(config, server.WithDeviceListener(broken), server.WithHTTPListener(httpLis))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Stop(context.Background())
+	var health common.Health
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status := getJSON(t, fmt.Sprintf("http://%s/health", httpLis.Addr()), &health)
+		if status == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the listener failure actual = %v", status)
+		}
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/health", httpLis.Addr()))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if health.Status != "failing" || !strings.Contains(health.FailedListeners["default"], "accept error") || len(health.FailedListeners) != 1 {
+		t.Fatalf("unexpected health: %+v", health)
+	}
+	var stats common.Stats
+	if getJSON(t, fmt.Sprintf("http://%s/stats", httpLis.Addr()), &stats) != http.StatusOK {
+		t.Fatal("expected stats")
+	}
+	if l := stats.Listeners["default"]; l.Serving || l.Error == "" {
+		t.Fatalf("expected the default listener to be reported as stopped actual = %+v", l)
+	}
+	if l := stats.Listeners["gateway"]; !l.Serving || l.Error != "" {
+		t.Fatalf("expected the gateway listener to be serving actual = %+v", l)
+	}
+}
+
+//openFiles returns the number of the process's descriptors open on path
+func openFiles(t *testing.T, path string) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("open descriptors aren't listed: %s", err)
+	}
+	open := 0
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err == nil && target == path {
+			open++
+		}
+	}
+	return open
+}
+
+//TestServerOutputsClosed fails if a server that fails to be created or started, or is never started, leaves its
+//output files open
+func TestServerOutputsClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thermomatic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer taken.Close()
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := ioutil.WriteFile(corrupt, []byte("{"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := server.DefaultConfig()
+	config.TcpAddr, config.TcpPort = "127.0.0.1", 0
+	config.HttpAddr, config.HttpPort = "127.0.0.1", 0
+	config.LogOutput = filepath.Join(dir, "server.log")
+	config.ReadingOutput = filepath.Join(dir, "readings.log")
+	var tests = []struct {
+		Name string
+		//Config modifies the config the server is created with
+		Config func(c *server.Config)
+		//Run creates the server & returns once it's done with it
+		Run func(t *testing.T, config *server.Config)
+	}{
+		{
+			Name:   "load failure",
+			Config: func(c *server.Config) { c.LastKnownFile = corrupt },
+			Run: func(t *testing.T, config *server.Config) {
+				if _, err := server.NewServer(config); err == nil {
+					t.Fatal("expected a corrupt last known file to fail")
+				}
+			},
+		},
+		{
+			Name:   "start failure",
+			Config: func(c *server.Config) { c.HttpPort = taken.Addr().(*net.TCPAddr).Port },
+			Run: func(t *testing.T, config *server.Config) {
+				s, err := server.NewServer(config)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err := s.Start(context.Background()); err == nil {
+					t.Fatal("expected binding a taken http port to fail")
+				}
+			},
+		},
+		{
+			Name:   "never started",
+			Config: func(c *server.Config) {},
+			Run: func(t *testing.T, config *server.Config) {
+				s, err := server.NewServer(config)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err := s.Stop(context.Background()); err == nil {
+					t.Fatal("expected stopping a server that wasn't started to fail")
+				}
+				if err := s.Start(context.Background()); err == nil {
+					t.Fatal("expected a stopped server not to start")
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			c := *config
+			test.Config(&c)
+			test.Run(t, &c)
+			for _, output := range []string{c.LogOutput, c.ReadingOutput} {
+				if open := openFiles(t, output); open != 0 {
+					t.Fatalf("expected %s to be closed, %v descriptors open", output, open)
+				}
+			}
+		})
+	}
+}
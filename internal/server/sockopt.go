@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+//tcpOptions are the socket options applied to every accepted tcp device connection
+type tcpOptions struct {
+	keepAlive   time.Duration
+	userTimeout time.Duration
+	noDelay     bool
+	readBuffer  int
+	writeBuffer int
+}
+
+func newTCPOptions(config *Config) tcpOptions {
+	return tcpOptions{
+		keepAlive:   time.Duration(config.TCPKeepAlive),
+		userTimeout: time.Duration(config.TCPUserTimeout),
+		noDelay:     config.TCPNoDelay,
+		readBuffer:  config.TCPReadBuffer,
+		writeBuffer: config.TCPWriteBuffer,
+	}
+}
+
+//apply sets the options on conn. Connections that aren't tcp(ex: unix sockets) are left untouched
+func (o tcpOptions) apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcp.SetKeepAlive(o.keepAlive > 0); err != nil {
+		return fmt.Errorf("keepalive: %s", err)
+	}
+	if o.keepAlive > 0 {
+		if err := tcp.SetKeepAlivePeriod(o.keepAlive); err != nil {
+			return fmt.Errorf("keepalive period: %s", err)
+		}
+	}
+	if err := tcp.SetNoDelay(o.noDelay); err != nil {
+		return fmt.Errorf("nodelay: %s", err)
+	}
+	if o.readBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.readBuffer); err != nil {
+			return fmt.Errorf("read buffer: %s", err)
+		}
+	}
+	if o.writeBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.writeBuffer); err != nil {
+			return fmt.Errorf("write buffer: %s", err)
+		}
+	}
+	if o.userTimeout > 0 {
+		if err := setUserTimeout(tcp, o.userTimeout); err != nil {
+			return fmt.Errorf("user timeout: %s", err)
+		}
+	}
+	return nil
+}
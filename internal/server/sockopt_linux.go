@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+//tcpUserTimeout is the TCP_USER_TIMEOUT socket option, which isn't defined by the syscall package
+const tcpUserTimeout = 0x12
+
+//userTimeoutSupported reports whether TCP_USER_TIMEOUT may be set on this platform
+const userTimeoutSupported = true
+
+//setUserTimeout sets how long data written to conn may go unacknowledged before the kernel closes it. Unlike keepalive
+//probes, it also detects peers that vanish while the server has unacknowledged data in flight(ex: a command)
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(timeout/time.Millisecond))
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
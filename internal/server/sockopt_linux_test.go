@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//TestTCPOptions fails if the socket options aren't set on an accepted tcp connection
+func TestTCPOptions(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lis.Close()
+	device, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer device.Close()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	config := DefaultConfig()
+	config.TCPKeepAlive = Duration(10 * time.Second)
+	config.TCPUserTimeout = Duration(20 * time.Second)
+	config.TCPNoDelay = false
+	if err := newTCPOptions(config).apply(conn); err != nil {
+		t.Fatal(err.Error())
+	}
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		Name          string
+		Level, Option int
+		Expected      int
+	}{
+		{Name: "keepalive", Level: syscall.SOL_SOCKET, Option: syscall.SO_KEEPALIVE, Expected: 1},
+		{Name: "keepalive idle time", Level: syscall.IPPROTO_TCP, Option: syscall.TCP_KEEPIDLE, Expected: 10},
+		{Name: "user timeout", Level: syscall.IPPROTO_TCP, Option: tcpUserTimeout, Expected: 20000},
+		{Name: "nodelay", Level: syscall.IPPROTO_TCP, Option: syscall.TCP_NODELAY, Expected: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var (
+				value  int
+				optErr error
+			)
+			raw.Control(func(fd uintptr) {
+				value, optErr = syscall.GetsockoptInt(int(fd), test.Level, test.Option)
+			})
+			if optErr != nil {
+				t.Fatal(optErr.Error())
+			}
+			if value != test.Expected {
+				t.Fatalf("expected %v actual = %v", test.Expected, value)
+			}
+		})
+	}
+}
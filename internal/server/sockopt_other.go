@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+//userTimeoutSupported reports whether TCP_USER_TIMEOUT may be set on this platform
+const userTimeoutSupported = false
+
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	return errors.New("TCP_USER_TIMEOUT is only supported on linux")
+}
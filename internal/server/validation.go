@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"github.com/autom8ter/thermomatic/internal/client"
+	"sort"
+	"strconv"
+)
+
+//defaultProfile is the name of the validation profile of devices that no other profile selects
+const defaultProfile = "default"
+
+//imeiDigits is the number of digits of an imei
+const imeiDigits = 15
+
+//validator builds the profile's validator on top of base, the bounds of fields the profile leaves out
+func (p *ValidationProfile) validator(base client.Validator) (client.Validator, error) {
+	v := base
+	v.Name = p.Name
+	for field, bound := range [...]*client.Bound{
+		client.FieldTemperature:  p.Temperature,
+		client.FieldAltitude:     p.Altitude,
+		client.FieldLatitude:     p.Latitude,
+		client.FieldLongitude:    p.Longitude,
+		client.FieldBatteryLevel: p.BatteryLevel,
+	} {
+		if bound != nil {
+			v.Bounds[field] = *bound
+		}
+	}
+	return v, v.Check()
+}
+
+//tacPrefix selects the devices whose imei starts with the prefix's digits
+type tacPrefix struct {
+	digits    int
+	value     uint64
+	validator *client.Validator
+}
+
+//matches reports whether the imei starts with the prefix. It does NOT allocate
+func (p *tacPrefix) matches(imei uint64) bool {
+	for i := p.digits; i < imeiDigits; i++ {
+		imei /= 10
+	}
+	return imei == p.value
+}
+
+//validators selects the validation profile of each device: the profile that lists its imei, then the profile with the
+//longest TAC prefix it starts with, then the default profile
+type validators struct {
+	fallback *client.Validator
+	imeis    map[uint64]*client.Validator
+	prefixes []tacPrefix
+}
+
+func newValidators(profiles []ValidationProfile) (*validators, error) {
+	fallback := client.DefaultValidator()
+	for i := range profiles {
+		if profiles[i].Name != defaultProfile {
+			continue
+		}
+		v, err := profiles[i].validator(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("validationProfiles[%v]: %s", i, err)
+		}
+		fallback = v
+	}
+	vs := &validators{
+		fallback: &fallback,
+		imeis:    map[uint64]*client.Validator{},
+	}
+	for i := range profiles {
+		p := &profiles[i]
+		if p.Name == defaultProfile {
+			continue
+		}
+		v, err := p.validator(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("validationProfiles[%v]: %s", i, err)
+		}
+		for _, imei := range p.IMEIs {
+			vs.imeis[imei] = &v
+		}
+		for _, prefix := range p.TACPrefixes {
+			value, err := strconv.ParseUint(prefix, 10, 64)
+			if err != nil || len(prefix) > imeiDigits {
+				return nil, fmt.Errorf("validationProfiles[%v]: tac prefix must be 1 to %v digits, got %q", i, imeiDigits, prefix)
+			}
+			vs.prefixes = append(vs.prefixes, tacPrefix{digits: len(prefix), value: value, validator: &v})
+		}
+	}
+	sort.SliceStable(vs.prefixes, func(i, j int) bool { return vs.prefixes[i].digits > vs.prefixes[j].digits })
+	return vs, nil
+}
+
+//forIMEI returns the validator of the device's profile
+func (vs *validators) forIMEI(imei uint64) *client.Validator {
+	if v, ok := vs.imeis[imei]; ok {
+		return v
+	}
+	for i := range vs.prefixes {
+		if vs.prefixes[i].matches(imei) {
+			return vs.prefixes[i].validator
+		}
+	}
+	return vs.fallback
+}
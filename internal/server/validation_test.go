@@ -0,0 +1,72 @@
+package server
+
+import (
+	"github.com/autom8ter/thermomatic/internal/client"
+	"testing"
+)
+
+func TestValidators(t *testing.T) {
+	hot := &client.Bound{Min: -300, Max: 1000}
+	profiles := []ValidationProfile{
+		{Name: "default", BatteryLevel: &client.Bound{Min: 0, Max: 100}},
+		{Name: "furnace", TACPrefixes: []string{"49015420"}, Temperature: hot},
+		{Name: "furnace-v2", TACPrefixes: []string{"490154203"}, Altitude: &client.Bound{Min: 0, Max: 10}},
+		{Name: "bench", IMEIs: []uint64{490154203237518}, Latitude: &client.Bound{Min: 0, Max: 1}},
+	}
+	vs, err := newValidators(profiles)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		Name    string
+		IMEI    uint64
+		Profile string
+	}{
+		{Name: "imei beats tac", IMEI: 490154203237518, Profile: "bench"},
+		{Name: "longest tac wins", IMEI: 490154203237526, Profile: "furnace-v2"},
+		{Name: "tac", IMEI: 490154201237510, Profile: "furnace"},
+		{Name: "no profile", IMEI: 356938035643809, Profile: "default"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			v := vs.forIMEI(test.IMEI)
+			if v.Name != test.Profile {
+				t.Fatalf("expected the %s profile, got %s", test.Profile, v.Name)
+			}
+			//every profile inherits the default profile's battery bound
+			if ok, _ := v.Validate(&client.Reading{BatteryLevel: 0}); !ok {
+				t.Errorf("expected the default profile's battery bound, got %s", v.Bounds[client.FieldBatteryLevel])
+			}
+		})
+	}
+	if got := vs.forIMEI(490154201237510).Bounds[client.FieldTemperature]; got != *hot {
+		t.Errorf("unexpected temperature bound: %s", got)
+	}
+	if got := vs.forIMEI(490154201237510).Bounds[client.FieldAltitude]; got != client.DefaultValidator().Bounds[client.FieldAltitude] {
+		t.Errorf("expected the default altitude bound, got %s", got)
+	}
+	if _, err := newValidators([]ValidationProfile{{Name: "x", TACPrefixes: []string{"49-01"}}}); err == nil {
+		t.Error("expected an invalid tac prefix to fail")
+	}
+	if _, err := newValidators([]ValidationProfile{{Name: "x", IMEIs: []uint64{1}, Temperature: &client.Bound{Min: 1, Max: 0}}}); err == nil {
+		t.Error("expected an empty bound to fail")
+	}
+	//profiles Validate rejects never reach a server's listeners
+	config := DefaultConfig()
+	config.ValidationProfiles = []ValidationProfile{{Name: "x", TACPrefixes: []string{"49-01"}}}
+	if config.Validate() == nil {
+		t.Error("expected a config with an invalid profile to fail validation")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected device listeners of an invalid config to panic")
+			}
+		}()
+		deviceListeners(config)
+	}()
+	allocs := testing.AllocsPerRun(100, func() { vs.forIMEI(490154201237510) })
+	if allocs != 0 {
+		t.Errorf("expected forIMEI not to allocate, got %v allocs", allocs)
+	}
+}
@@ -2,21 +2,40 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"github.com/autom8ter/thermomatic/internal/server"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
+	config, printConfig, err := server.LoadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if printConfig {
+		fmt.Println(config.String())
+		return
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	s, err := server.NewServer(&server.Config{
-		TcpPort:         1337,
-		HttpPort:        1338,
-		ClientLogPrefix: "Thermomatic-Client: ",
-		ServerLogPrefix: "Thermomatic-Server: ",
-	})
+	s, err := server.NewServer(config)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	//cancel the server's context on SIGINT/SIGTERM so it can drain connections and exit gracefully
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("received signal: %s", sig)
+		cancel()
+	}()
 	s.Listen(ctx)
 }
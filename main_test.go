@@ -1,13 +1,16 @@
 package main_test
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/autom8ter/thermomatic/internal/client"
+	"github.com/autom8ter/thermomatic/internal/server"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	url2 "net/url"
+	"os"
 	"testing"
 	"time"
 )
@@ -16,6 +19,30 @@ var (
 	imei = "450154603277518"
 )
 
+//TestMain starts a thermomatic server on localhost:1337 & localhost:1338 unless one is already running, and shuts it
+//down gracefully once the tests complete.
+func TestMain(m *testing.M) {
+	if conn, err := net.Dial("tcp", "localhost:1337"); err == nil {
+		conn.Close()
+		os.Exit(m.Run())
+	}
+	s, err := server.NewServer(server.DefaultConfig())
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	//Start returns once both listeners are ready
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err.Error())
+	}
+	code := m.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		log.Print(err.Error())
+	}
+	os.Exit(code)
+}
+
 func TestE2E(t *testing.T) {
 	conn, err := net.Dial("tcp", "localhost:1337")
 	if err != nil {